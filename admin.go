@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"bot"
+	"command"
+	"fileutil"
+)
+
+// An assignment records the changes made to one bot with !bot.
+type assignment struct {
+	Enabled bool `json:"enabled"`
+	// Channels the bot was told to hear from (true) or not (false)
+	Channels map[string]bool `json:"channels,omitempty"`
+}
+
+// botState holds the assignments for every connection, by connection name and then bot name. If it has a
+// path, it's saved there after every change so that the changes survive restarts.
+type botState struct {
+	path string
+
+	mu          sync.Mutex
+	assignments map[string]map[string]*assignment
+}
+
+// loadBotState reads the state saved at path. A missing file is fine; so is an empty path, which means
+// changes aren't saved at all.
+func loadBotState(path string) (*botState, error) {
+	s := &botState{path: path, assignments: make(map[string]map[string]*assignment)}
+	if path == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.assignments); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return s, nil
+}
+
+// get returns a copy of the assignments for the named connection.
+func (s *botState) get(account string) map[string]assignment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assignments := make(map[string]assignment)
+	for name, a := range s.assignments[account] {
+		assignments[name] = *a
+	}
+	return assignments
+}
+
+// update changes the assignment of a bot with f and saves the result. A new assignment starts out with
+// Enabled set to enabled.
+func (s *botState) update(account, name string, enabled bool, f func(a *assignment)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bots, ok := s.assignments[account]
+	if !ok {
+		bots = make(map[string]*assignment)
+		s.assignments[account] = bots
+	}
+	a, ok := bots[name]
+	if !ok {
+		a = &assignment{Enabled: enabled, Channels: make(map[string]bool)}
+		bots[name] = a
+	}
+	if a.Channels == nil {
+		a.Channels = make(map[string]bool)
+	}
+	f(a)
+	return s.save()
+}
+
+// save writes the state to the file.
+func (s *botState) save() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(s.assignments, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteFile(s.path, b)
+}
+
+// applyState starts, stops and assigns channels to the bots according to the saved state. It's called
+// before the bots are sent EventConnect.
+func (in *instance) applyState() {
+	running := make(map[string]bool)
+	for _, s := range in.disp.Bots() {
+		running[s.Name] = true
+	}
+	for name, a := range in.settings.state.get(in.name) {
+		if _, ok := botNameToFunc[name]; !ok {
+			continue
+		}
+		if !running[name] {
+			if !a.Enabled {
+				continue
+			}
+			in.startBot(name)
+		}
+		in.disp.Enable(name, a.Enabled)
+		for channel, hear := range a.Channels {
+			in.disp.EnableIn(name, channel, hear)
+		}
+	}
+}
+
+// adminBot handles !bot, which lets admins turn bots on and off and change the channels they listen in
+// without restarting.
+type adminBot struct {
+	in       *instance
+	admins   map[string]bool
+	commands *command.Set
+}
+
+func newAdminBot(in *instance, admins []string) *adminBot {
+	b := &adminBot{in: in, admins: make(map[string]bool)}
+	for _, a := range admins {
+		b.admins[a] = true
+	}
+	b.commands = in.env.Commands.NewSet("admin", nil)
+	b.commands.Add(&command.Command{
+		Name: "bot",
+		Help: "Manage bots (admins only): list, enable <bot> [in <channel>], disable <bot> [in <channel>].",
+		Args: []command.Arg{
+			{Name: "list|enable|disable"},
+			{Name: "bot", Optional: true},
+			{Name: "in channel", Optional: true, Rest: true},
+		},
+		Run: b.run,
+	})
+	return b
+}
+
+func (b *adminBot) Subscription() *bot.Subscription {
+	return &bot.Subscription{Types: []bot.EventType{bot.EventPublishMessage}}
+}
+
+func (b *adminBot) Handle(e *bot.Event) {
+	m := e.Payload.(bot.PublishMessage)
+	b.commands.Handle(m.Data.Channel, m.Data.User.Username, m.Data.Message)
+}
+
+func (b *adminBot) run(c *command.Context) error {
+	if !b.admins[c.Username] {
+		return errors.New("only admins can manage bots")
+	}
+	action := c.Arg("list|enable|disable")
+	if action == "list" {
+		if c.Arg("bot") != "" {
+			return command.Usagef("list takes no arguments")
+		}
+		c.Reply(b.list())
+		return nil
+	}
+	if action != "enable" && action != "disable" {
+		return command.Usagef("unknown action %q", action)
+	}
+	name := c.Arg("bot")
+	if name == "" {
+		return command.Usagef("which bot?")
+	}
+	if _, ok := botNameToFunc[name]; !ok {
+		return fmt.Errorf("there's no bot called %s", name)
+	}
+	channel := ""
+	if where := strings.Fields(c.Arg("in channel")); len(where) > 0 {
+		if len(where) != 2 || where[0] != "in" {
+			return command.Usagef(`expected "in <channel>"`)
+		}
+		channel = where[1]
+	}
+	enable := action == "enable"
+
+	running, enabled := false, false
+	for _, s := range b.in.disp.Bots() {
+		if s.Name == name {
+			running, enabled = true, s.Enabled
+		}
+	}
+	started := false
+	if enable && !running {
+		b.in.startBot(name)
+		// This sends it EventConnect.
+		b.in.disp.Enable(name, true)
+		running, enabled, started = true, true, true
+	}
+	if running {
+		if channel == "" {
+			b.in.disp.Enable(name, enable)
+		} else {
+			b.in.disp.EnableIn(name, channel, enable)
+		}
+	}
+	err := b.in.settings.state.update(b.in.name, name, enabled, func(a *assignment) {
+		if channel == "" {
+			a.Enabled = enable
+		} else {
+			a.Channels[channel] = enable
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't save the change (it'll be lost on restart): %s", err)
+	}
+
+	msg := "Disabled " + name
+	if enable {
+		msg = "Enabled " + name
+	}
+	if channel != "" {
+		msg += " in " + channel
+	}
+	msg += "."
+	switch {
+	case channel != "" && started:
+		msg += fmt.Sprintf(" (It wasn't running, so it's now on in all its channels too; use `!bot disable %s in <channel>` to turn it off elsewhere.)", name)
+	case channel != "" && enable && !enabled:
+		msg += fmt.Sprintf(" (It's still disabled everywhere; use `!bot enable %s` to turn it on.)", name)
+	}
+	c.Reply(msg)
+	return nil
+}
+
+// list describes every bot.
+func (b *adminBot) list() string {
+	statuses := make(map[string]string)
+	for _, s := range b.in.disp.Bots() {
+		if _, ok := botNameToFunc[s.Name]; !ok {
+			continue
+		}
+		status := "**off**"
+		if s.Enabled {
+			status = "**on**"
+		}
+		if s.Channels == nil {
+			status += ", in all channels"
+		} else if len(s.Channels) == 0 {
+			status += ", in no channels"
+		} else {
+			status += ", in " + strings.Join(s.Channels, ", ")
+		}
+		if len(s.Excluded) > 0 {
+			status += "; not in " + strings.Join(s.Excluded, ", ")
+		}
+		statuses[s.Name] = status
+	}
+	var lines []string
+	for name := range botNameToFunc {
+		status, ok := statuses[name]
+		if !ok {
+			status = "**off** (not running)"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", name, status))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"code.google.com/p/go.net/proxy"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"authutil"
+	"bot"
+	"command"
+	"connection"
+	"dispatcher"
+	"pratapi"
+	"scheduler"
+)
+
+// An account describes one connection to run: a Prat server, the credentials to use there and the bots to
+// run on it.
+type account struct {
+	Name      string   `json:"name"`
+	Server    string   `json:"server"`
+	Port      int      `json:"port"`
+	TLS       *bool    `json:"tls"`
+	APIKey    string   `json:"apikey"`
+	Secret    string   `json:"secret"`
+	Bots      []string `json:"bots"`
+	QueueFile string   `json:"queuefile"`
+	// Where to keep scheduled jobs that bots want to survive restarts
+	ScheduleFile string `json:"schedulefile"`
+
+	// Instead of giving the api key and secret above, they can be read from a file (see
+	// authutil.FileSource) or from environment variables.
+	CredFile  string `json:"credfile"`
+	APIKeyEnv string `json:"apikeyenv"`
+	SecretEnv string `json:"secretenv"`
+
+	// Users who may use !bot (in addition to -admins)
+	Admins []string `json:"admins"`
+	// Middleware settings for particular bots, by name
+	BotOptions map[string]*botOptions `json:"botoptions"`
+	// Settings for the github bot
+	Github *bot.GithubOptions `json:"github"`
+
+	// How to verify the server and what to present to it (see connection.TLSOptions), and the proxy to
+	// connect through. Anything left out is taken from the corresponding flag (-cafile, -pins and so on).
+	// An empty list of pins overrides -pins, and a proxy of "direct" overrides -proxy and $ALL_PROXY.
+	CAFile     string   `json:"cafile"`
+	Pins       []string `json:"pins"`
+	ClientCert string   `json:"clientcert"`
+	ClientKey  string   `json:"clientkey"`
+	ServerName string   `json:"servername"`
+	Insecure   *bool    `json:"insecure"`
+	Proxy      string   `json:"proxy"`
+	NoProxy    string   `json:"noproxy"`
+
+	// The config file the account came from, if any
+	configFile string
+	// The credentials, loaded by check and reloaded on SIGHUP
+	creds *authutil.Cached
+	// Built by check from the settings above
+	tlsOptions *connection.TLSOptions
+	dialer     proxy.Dialer
+}
+
+// readConfig reads a list of accounts from a JSON file of the form
+//
+//	{"connections": [{"name": "prod", "server": "pratchat.com", "apikey": "...", ...}, ...]}
+//
+// Settings for the github bot go in "github", e.g.
+//
+//	"github": {"addr": "localhost:9898", "webhookkeys": {"relaykey": "relaysecret"}}
+//
+// and each connection can have its own TLS and proxy settings, e.g.
+//
+//	"servername": "chat.internal", "pins": ["ab:cd:..."], "proxy": "socks5://localhost:1080"
+func readConfig(path string) ([]*account, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var config struct {
+		Connections []*account `json:"connections"`
+	}
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, a := range config.Connections {
+		if names[a.Name] {
+			return nil, fmt.Errorf("duplicate connection name %q", a.Name)
+		}
+		names[a.Name] = true
+	}
+	return config.Connections, nil
+}
+
+// check validates a and fills in defaults, some of them from s.
+func (a *account) check(s *settings) error {
+	a.configFile = s.configFile
+	if a.Name == "" {
+		return errors.New("connection with no name")
+	}
+	if a.Server == "" {
+		return fmt.Errorf("[%s] must specify a server", a.Name)
+	}
+	creds, err := authutil.NewCached(a.source())
+	if err != nil {
+		return fmt.Errorf("[%s] couldn't load credentials: %s", a.Name, err)
+	}
+	a.creds = creds
+	if a.TLS == nil {
+		useTLS := true
+		a.TLS = &useTLS
+	}
+	if a.Port == 0 {
+		if *a.TLS {
+			a.Port = 443
+		} else {
+			a.Port = 80
+		}
+	}
+	var bots []string
+	for _, name := range a.Bots {
+		if name == "" {
+			continue
+		}
+		if _, ok := botNameToFunc[name]; !ok {
+			return fmt.Errorf("[%s] unrecognized bot: %s", a.Name, name)
+		}
+		bots = append(bots, name)
+	}
+	if len(bots) == 0 {
+		return fmt.Errorf("[%s] must specify one or more bots to run", a.Name)
+	}
+	if a.Github != nil && len(a.Github.WebhookKeys) > 0 && a.configFile != "" {
+		if err := authutil.CheckPermissions(a.configFile); err != nil {
+			log.Printf("[%s] Warning: %s", a.Name, err)
+		}
+	}
+	for name, o := range a.BotOptions {
+		if _, ok := botNameToFunc[name]; !ok {
+			return fmt.Errorf("[%s] options for unrecognized bot: %s", a.Name, name)
+		}
+		if err := o.check(); err != nil {
+			return fmt.Errorf("[%s] %s", a.Name, err)
+		}
+	}
+	a.Bots = bots
+	return a.checkNetwork(s)
+}
+
+// checkNetwork fills in a's TLS and proxy settings from s and checks them.
+func (a *account) checkNetwork(s *settings) error {
+	a.tlsOptions = &connection.TLSOptions{
+		CAFile:     a.CAFile,
+		Pins:       a.Pins,
+		CertFile:   a.ClientCert,
+		KeyFile:    a.ClientKey,
+		ServerName: a.ServerName,
+		Insecure:   s.tls.Insecure,
+	}
+	if a.CAFile == "" {
+		a.tlsOptions.CAFile = s.tls.CAFile
+	}
+	if a.Pins == nil {
+		a.tlsOptions.Pins = s.tls.Pins
+	}
+	if a.ClientCert == "" && a.ClientKey == "" {
+		a.tlsOptions.CertFile, a.tlsOptions.KeyFile = s.tls.CertFile, s.tls.KeyFile
+	}
+	if a.ServerName == "" {
+		a.tlsOptions.ServerName = s.tls.ServerName
+	}
+	if a.Insecure != nil {
+		a.tlsOptions.Insecure = *a.Insecure
+	}
+	if _, err := a.tlsOptions.Config(); err != nil {
+		return fmt.Errorf("[%s] bad TLS settings: %s", a.Name, err)
+	}
+
+	proxyTo, direct := a.Proxy, a.NoProxy
+	if proxyTo == "" {
+		proxyTo = s.proxy
+	}
+	if direct == "" {
+		direct = s.noProxy
+	}
+	if proxyTo == "direct" {
+		a.dialer = proxy.Direct
+		return nil
+	}
+	var err error
+	if a.dialer, err = connection.ProxyDialer(proxyTo, direct); err != nil {
+		return fmt.Errorf("[%s] bad proxy settings: %s", a.Name, err)
+	}
+	return nil
+}
+
+// githubAddr returns where a's github bot listens, or "" if a doesn't run it.
+func (a *account) githubAddr() string {
+	for _, name := range a.Bots {
+		if name != "github" {
+			continue
+		}
+		if a.Github != nil && a.Github.Addr != "" {
+			return a.Github.Addr
+		}
+		return bot.DefaultGithubAddr
+	}
+	return ""
+}
+
+// botOptions says which middleware to run bots with.
+type botOptions struct {
+	LogEvents bool    `json:"logevents"`
+	UserRate  float64 `json:"userrate"`
+	UserBurst int     `json:"userburst"`
+	// Channel patterns
+	Allow []string `json:"allowchannels"`
+	Deny  []string `json:"denychannels"`
+}
+
+func (o *botOptions) check() error {
+	if o == nil {
+		return nil
+	}
+	for _, patterns := range [][]string{o.Allow, o.Deny} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("bad channel pattern %q", p)
+			}
+		}
+	}
+	return nil
+}
+
+func (o *botOptions) middleware() []dispatcher.Middleware {
+	if o == nil {
+		return nil
+	}
+	var mws []dispatcher.Middleware
+	if len(o.Allow) > 0 {
+		mws = append(mws, dispatcher.AllowChannels(o.Allow...))
+	}
+	if len(o.Deny) > 0 {
+		mws = append(mws, dispatcher.DenyChannels(o.Deny...))
+	}
+	if o.UserRate > 0 {
+		mws = append(mws, dispatcher.RateLimitUsers(o.UserRate, o.UserBurst))
+	}
+	// Last, so that only the events that get through to the bot are logged
+	if o.LogEvents {
+		mws = append(mws, dispatcher.LogEvents)
+	}
+	return mws
+}
+
+// source returns where a's credentials come from.
+func (a *account) source() authutil.Source {
+	switch {
+	case a.CredFile != "":
+		return authutil.FileSource{Path: a.CredFile}
+	case a.APIKeyEnv != "" || a.SecretEnv != "":
+		return authutil.EnvSource{APIKeyVar: a.APIKeyEnv, SecretVar: a.SecretEnv}
+	case a.configFile != "":
+		return configSource{path: a.configFile, name: a.Name}
+	}
+	return authutil.Static{APIKey: a.APIKey, Secret: a.Secret}
+}
+
+// configSource reads an account's credentials from the config file, so that they can be changed there
+// without a restart.
+type configSource struct {
+	path, name string
+}
+
+func (s configSource) Credentials() (string, string, error) {
+	accounts, err := readConfig(s.path)
+	if err != nil {
+		return "", "", err
+	}
+	for _, a := range accounts {
+		if a.Name != s.name {
+			continue
+		}
+		if a.APIKey == "" || a.Secret == "" {
+			return "", "", fmt.Errorf("no api key and secret for %s in %s", s.name, s.path)
+		}
+		if err := authutil.CheckPermissions(s.path); err != nil {
+			log.Printf("[%s] Warning: %s", s.name, err)
+		}
+		return a.APIKey, a.Secret, nil
+	}
+	return "", "", fmt.Errorf("%s is no longer in %s", s.name, s.path)
+}
+
+// reloadCredentials reloads every account's credentials. Connections use the new ones the next time they
+// reconnect.
+func reloadCredentials(accounts []*account) {
+	for _, a := range accounts {
+		if err := a.creds.Reload(); err != nil {
+			log.Printf("[%s] Couldn't reload credentials (keeping the old ones): %s", a.Name, err)
+			continue
+		}
+		log.Printf("[%s] Reloaded credentials.", a.Name)
+	}
+}
+
+func (a *account) addrs() (wsAddr, httpAddr string) {
+	proto := ""
+	if *a.TLS {
+		proto = "s"
+	}
+	wsAddr = fmt.Sprintf("ws%s://%s:%d", proto, a.Server, a.Port)
+	httpAddr = fmt.Sprintf("http%s://%s:%d", proto, a.Server, a.Port)
+	return wsAddr, httpAddr
+}
+
+// An instance is a running connection with its own dispatcher and bots.
+type instance struct {
+	name     string
+	account  *account
+	settings *settings
+	conn     *connection.Conn
+	disp     *dispatcher.Dispatcher
+	env      *bot.Env
+	sched    *scheduler.Scheduler
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// start connects to a's server and starts its bots.
+func start(a *account, s *settings) (*instance, error) {
+	wsAddr, httpAddr := a.addrs()
+	tlsConfig, err := a.tlsOptions.Config()
+	if err != nil {
+		return nil, err
+	}
+	api := pratapi.NewWithCredentials(httpAddr, a.creds, tlsConfig, a.dialer)
+
+	// Get info about ourself.
+	me, err := api.WhoAmI()
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching user info: %s", err)
+	}
+	userInfo := &bot.UserInfo{User: bot.UserFrom(me)}
+
+	opts := s.conn
+	opts.Name = a.Name
+	opts.Username = me.Username
+	opts.QueueFile = a.QueueFile
+	opts.TLS = a.tlsOptions
+	opts.Dialer = a.dialer
+	conn, err := connection.ConnectCredentials(wsAddr, a.creds, &opts)
+	if err != nil {
+		return nil, err
+	}
+	set.Add(conn)
+
+	// Leave all current channels.
+	for _, channel := range userInfo.User.Channels {
+		conn.Leave(channel)
+	}
+
+	// Register bots
+	in := &instance{
+		name:     a.Name,
+		account:  a,
+		settings: s,
+		conn:     conn,
+		disp:     dispatcher.NewWithOptions(&s.disp),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	in.sched, err = scheduler.New(a.ScheduleFile, in.fire)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error loading scheduled jobs: %s", err)
+	}
+	commands := command.NewRegistry(func(channel, msg string) {
+		if err := conn.SendMessage(channel, msg); err != nil {
+			log.Printf("[%s] Couldn't send help: %s", a.Name, err)
+		}
+	})
+	commands.SetHears(in.disp.Hears)
+	in.env = &bot.Env{
+		Conn:      conn,
+		UI:        userInfo,
+		API:       api,
+		Commands:  commands,
+		Scheduler: in.sched,
+		Bus:       in.disp,
+		Switches:  in.disp,
+
+		Github: a.Github,
+	}
+	in.disp.Use(dispatcher.IgnoreSelf(userInfo))
+	in.disp.Use(s.bots.middleware()...)
+	for _, name := range a.Bots {
+		in.startBot(name)
+	}
+	in.applyState()
+	in.disp.Register("help", bot.NewHelp(in.env))
+	if admins := append(append([]string(nil), s.admins...), a.Admins...); len(admins) > 0 {
+		in.disp.Register("admin", newAdminBot(in, admins))
+	}
+	in.disp.AutoJoin(conn)
+
+	log.Printf("[%s] Bots started.", a.Name)
+
+	// Send 'connected' message
+	connectedMsg := &bot.Event{
+		Type: bot.EventConnect,
+	}
+	in.disp.Send(connectedMsg)
+	in.sched.Start()
+	return in, nil
+}
+
+// fire delivers a scheduled job to the bot that owns it.
+func (in *instance) fire(j scheduler.Job, t time.Time) {
+	e := &bot.Event{
+		Type:    bot.EventTimer,
+		Payload: bot.Timer{ID: j.ID, Data: j.Data, Time: t},
+	}
+	if !in.disp.SendTo(j.Owner, e) {
+		log.Printf("[%s] Warning: no %s bot for scheduled job %s.", in.name, j.Owner, j.ID)
+	}
+}
+
+// startBot creates and registers the named bot.
+func (in *instance) startBot(name string) {
+	b := botNameToFunc[name](in.env)
+	in.disp.Register(name, b, in.account.BotOptions[name].middleware()...)
+}
+
+// run loops, receiving messages and state changes, and sends them through the dispatcher until shutdown.
+func (in *instance) run() {
+	defer close(in.done)
+	for {
+		select {
+		case e := <-in.conn.In:
+			in.disp.Deliver(e)
+		case s := <-in.conn.States:
+			in.disp.SendState(s)
+		case <-in.quit:
+			return
+		}
+	}
+}
+
+// shutdown stops the instance, tells the bots we're stopping, sends whatever we can of the outgoing
+// messages and closes the connection. It returns the exit status: nonzero if messages were left unsent or
+// closing failed.
+func (in *instance) shutdown() int {
+	close(in.quit)
+	in.sched.Stop()
+	// Neither of these waits for bots, so a stuck one can't hold us up past the drain timeout.
+	in.disp.Send(&bot.Event{Type: bot.EventShutdown})
+	status := 0
+	if !in.disp.Stop(in.settings.drainTimeout) {
+		log.Printf("[%s] Gave up waiting for bots to finish.", in.name)
+		status = 1
+	}
+	// run may have been waiting to deliver an event to a bot with a full queue; Stop lets it go.
+	<-in.done
+	in.logStats()
+	if in.settings.leaveOnExit {
+		for _, channel := range in.conn.Channels() {
+			in.conn.Leave(channel)
+		}
+	}
+	if n := in.conn.Flush(in.settings.drainTimeout); n > 0 {
+		log.Printf("[%s] Gave up on %d unsent messages.", in.name, n)
+		status = 1
+	}
+	if err := in.conn.Close(); err != nil {
+		log.Printf("[%s] Error closing connection: %s", in.name, err)
+		status = 1
+	}
+	return status
+}
+
+// logStats logs how much work each bot did.
+func (in *instance) logStats() {
+	for name, s := range in.disp.Stats() {
+		var avg time.Duration
+		if s.Handled > 0 {
+			avg = s.Total / time.Duration(s.Handled)
+		}
+		log.Printf("[%s] %s bot: handled %d events (average %s, longest %s); dropped %d; panicked %d times.",
+			in.name, name, s.Handled, avg, s.Max, s.Dropped, s.Panics)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"bot"
+	"dispatcher"
+	"prattest"
+)
+
+const testTimeout = 5 * time.Second
+
+var (
+	botUser = &prattest.User{APIKey: "botkey", Secret: "botsecret", Username: "pratbot", Name: "Prat Bot"}
+	alice   = &prattest.User{APIKey: "alicekey", Secret: "alicesecret", Username: "alice", Name: "Alice"}
+)
+
+// testSettings returns the settings the flags give by default, without saving anything.
+func testSettings(t *testing.T) *settings {
+	state, err := loadBotState("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &settings{
+		disp:         dispatcher.DefaultOptions,
+		bots:         &botOptions{},
+		state:        state,
+		drainTimeout: time.Second,
+	}
+}
+
+// newServer starts a fake Prat server with the bot's account and alice's.
+func newServer(t *testing.T) *prattest.Server {
+	srv := prattest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.AddUser(botUser)
+	srv.AddUser(alice)
+	return srv
+}
+
+// startBots starts a connection to srv running bots, after letting configure change the account, and shuts
+// it down at the end of the test.
+func startBots(t *testing.T, srv *prattest.Server, s *settings, configure func(a *account)) *instance {
+	host, port, err := net.SplitHostPort(srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTLS := false
+	a := &account{Name: "test", Server: host, TLS: &useTLS, APIKey: botUser.APIKey, Secret: botUser.Secret}
+	a.Port, _ = strconv.Atoi(port)
+	if configure != nil {
+		configure(a)
+	}
+	if err := a.check(s); err != nil {
+		t.Fatal(err)
+	}
+	in, err := start(a, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go in.run()
+	t.Cleanup(func() {
+		if status := in.shutdown(); status != 0 {
+			t.Errorf("shutdown() = %d", status)
+		}
+	})
+	return in
+}
+
+// waitFor waits for cond to become true.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// joined waits for the bot to be in channel.
+func joined(t *testing.T, srv *prattest.Server, channel string) {
+	waitFor(t, "the bot to join "+channel, func() bool {
+		for _, c := range srv.Channels(botUser) {
+			if c == channel {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// reply publishes msg from alice in channel and returns the next message the bot publishes there.
+func reply(t *testing.T, srv *prattest.Server, channel, msg string) string {
+	before, _ := srv.WaitForMessages(channel, 0, 0)
+	srv.Publish(alice, channel, msg)
+	msgs, err := srv.WaitForMessages(channel, len(before)+2, testTimeout)
+	if err != nil {
+		t.Fatalf("no reply to %q: %s", msg, err)
+	}
+	m := msgs[len(before)+1]
+	if m.User != botUser {
+		t.Fatalf("%s replied to %q", m.User.Username, msg)
+	}
+	return m.Message
+}
+
+func TestEcho(t *testing.T) {
+	srv := newServer(t)
+	srv.Join(botUser, "left-over")
+	srv.Join(alice, "bot-test")
+	startBots(t, srv, testSettings(t), func(a *account) { a.Bots = []string{"echo"} })
+
+	joined(t, srv, "bot-test")
+	// Channels the bot was in from before are left.
+	waitFor(t, "the bot to leave left-over", func() bool { return len(srv.Channels(botUser)) == 1 })
+
+	if got, want := reply(t, srv, "bot-test", "hello"), "**HELLO**"; got != want {
+		t.Errorf("echoed %q; want %q", got, want)
+	}
+	if got, want := reply(t, srv, "bot-test", "again"), "**AGAIN**"; got != want {
+		t.Errorf("echoed %q; want %q", got, want)
+	}
+	// The bot doesn't echo itself, or anything elsewhere.
+	srv.Publish(alice, "random", "hello?")
+	time.Sleep(100 * time.Millisecond)
+	if msgs, _ := srv.WaitForMessages("bot-test", 0, 0); len(msgs) != 4 {
+		t.Errorf("%d messages in bot-test; want 4", len(msgs))
+	}
+	if msgs, _ := srv.WaitForMessages("random", 0, 0); len(msgs) != 1 {
+		t.Errorf("%d messages in random; want 1", len(msgs))
+	}
+}
+
+// freeAddr returns a local address that's free to listen on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// notify posts a push notification to the github bot at addr, retrying until it's listening.
+func notify(t *testing.T, addr, repo string) {
+	payload := fmt.Sprintf(`{
+		"repository": {"name": %q, "url": "https://github.com/cespare/%s"},
+		"commits": [{
+			"id": "0123456789abcdef",
+			"message": "Fix the thing\n\nAt length.",
+			"url": "https://github.com/cespare/%s/commit/0123456789abcdef",
+			"author": {"name": "Alice", "username": "alice"}
+		}]
+	}`, repo, repo, repo)
+	var resp *http.Response
+	waitFor(t, "the github bot to listen", func() bool {
+		var err error
+		resp, err = http.PostForm("http://"+addr+"/", url.Values{"payload": {payload}})
+		return err == nil
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("notification got %s", resp.Status)
+	}
+}
+
+func TestGithub(t *testing.T) {
+	issues := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/cespare/pratbot/issues/12" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"html_url": "https://github.com/cespare/pratbot/issues/12", "state": "open", "title": "Make it go"}`)
+	}))
+	defer issues.Close()
+	api := bot.GithubAPI
+	bot.GithubAPI = issues.URL
+	defer func() { bot.GithubAPI = api }()
+
+	srv := newServer(t)
+	srv.Join(alice, "pratbot")
+	addr := freeAddr(t)
+	startBots(t, srv, testSettings(t), func(a *account) {
+		a.Bots = []string{"github"}
+		a.Github = &bot.GithubOptions{Addr: addr}
+	})
+	joined(t, srv, "pratbot")
+
+	notify(t, addr, "pratbot")
+	want := "**[GithubBot]** [Alice](https://github.com/alice) authored [01234567](https://github.com/cespare/pratbot/commit/0123456789abcdef) in [pratbot](https://github.com/cespare/pratbot): \"Fix the thing\""
+	for _, channel := range []string{"pratbot", "bot-test"} {
+		msgs, err := srv.WaitForMessages(channel, 1, testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgs[0].User != botUser || msgs[0].Message != want {
+			t.Errorf("posted %q in %s; want %q", msgs[0].Message, channel, want)
+		}
+	}
+
+	for _, tt := range []struct{ cmd, want string }{
+		{"!issue 12", "**[GithubBot]** [Issue #12 in cespare/pratbot:](https://github.com/cespare/pratbot/issues/12) Make it go **[open]**"},
+		{"!issue cespare/pratbot 12", "**[GithubBot]** [Issue #12 in cespare/pratbot:](https://github.com/cespare/pratbot/issues/12) Make it go **[open]**"},
+		{"!issue 13", "**[GithubBot]** No such issue."},
+		{"!issue twelve", "**[GithubBot]** **error:** bad issue (should be a number): twelve (usage: `!issue [owner/repo] <number>`)"},
+	} {
+		if got := reply(t, srv, "pratbot", tt.cmd); got != tt.want {
+			t.Errorf("%s replied %q; want %q", tt.cmd, got, tt.want)
+		}
+	}
+	if got := reply(t, srv, "pratbot", "!help"); !strings.Contains(got, "!issue") {
+		t.Errorf("!help replied %q", got)
+	}
+}
+
+func TestGithubWebhookKeys(t *testing.T) {
+	srv := newServer(t)
+	addr := freeAddr(t)
+	startBots(t, srv, testSettings(t), func(a *account) {
+		a.Bots = []string{"github"}
+		a.Github = &bot.GithubOptions{Addr: addr, WebhookKeys: map[string]string{"relay": "relaysecret"}}
+	})
+	var resp *http.Response
+	waitFor(t, "the github bot to listen", func() bool {
+		var err error
+		resp, err = http.PostForm("http://"+addr+"/", url.Values{"payload": {`{}`}})
+		return err == nil
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned notification got %s", resp.Status)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	srv := newServer(t)
+	srv.Join(alice, "pratbot")
+	srv.Join(alice, "ops")
+	s := testSettings(t)
+	s.admins = []string{"alice"}
+	in := startBots(t, srv, s, func(a *account) {
+		a.Bots = []string{"github"}
+		a.Github = &bot.GithubOptions{Addr: freeAddr(t)}
+	})
+	joined(t, srv, "pratbot")
+
+	if got := reply(t, srv, "pratbot", "!help"); !strings.Contains(got, "!issue") || !strings.Contains(got, "!bot") {
+		t.Errorf("!help replied %q", got)
+	}
+	if got, want := reply(t, srv, "pratbot", "!bot disable github"), "Disabled github."; got != want {
+		t.Errorf("replied %q; want %q", got, want)
+	}
+	// Disabled bots' commands aren't listed.
+	if got := reply(t, srv, "pratbot", "!help"); strings.Contains(got, "!issue") || !strings.Contains(got, "!bot") {
+		t.Errorf("!help replied %q with github disabled", got)
+	}
+
+	// Enabling a bot that isn't running in one channel turns it on everywhere, and says so.
+	got := reply(t, srv, "pratbot", "!bot enable echo in ops")
+	if !strings.HasPrefix(got, "Enabled echo in ops.") || !strings.Contains(got, "all its channels") {
+		t.Errorf("replied %q", got)
+	}
+	joined(t, srv, "ops")
+	joined(t, srv, "bot-test")
+	if got, want := reply(t, srv, "ops", "hi"), "**HI**"; got != want {
+		t.Errorf("echoed %q; want %q", got, want)
+	}
+	saved := in.settings.state.get("test")
+	if !saved["echo"].Enabled || !saved["echo"].Channels["ops"] || saved["github"].Enabled {
+		t.Errorf("saved %+v", saved)
+	}
+
+	if got, want := reply(t, srv, "pratbot", "!bot list"), "echo: **on**, in bot-test, ops\ngithub: **off**, in barkeep, bot-test, general, prat, pratbot"; got != want {
+		t.Errorf("!bot list replied %q; want %q", got, want)
+	}
+}
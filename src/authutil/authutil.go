@@ -2,23 +2,36 @@ package authutil
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// DefaultExpiry is how long signatures are valid for when a Signer doesn't say otherwise.
+var DefaultExpiry = 5 * time.Minute
+
 type ByPair [][]string
 
-func (p ByPair) Len() int           { return len(p) }
-func (p ByPair) Less(i, j int) bool { return p[i][0] < p[j][0] }
-func (p ByPair) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p ByPair) Len() int      { return len(p) }
+func (p ByPair) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p ByPair) Less(i, j int) bool {
+	if p[i][0] != p[j][0] {
+		return p[i][0] < p[j][0]
+	}
+	return p[i][1] < p[j][1]
+}
 
-func prepareQueryString(params map[string]string, exclude []string) string {
+func prepareQueryString(params url.Values, exclude []string) string {
 	var result [][]string
-	for k, v := range params {
+	for k, vs := range params {
 		excluded := false
 		for _, e := range exclude {
 			if k == e {
@@ -26,7 +39,10 @@ func prepareQueryString(params map[string]string, exclude []string) string {
 				break
 			}
 		}
-		if !excluded {
+		if excluded {
+			continue
+		}
+		for _, v := range vs {
 			result = append(result, []string{k, v})
 		}
 	}
@@ -39,6 +55,16 @@ func prepareQueryString(params map[string]string, exclude []string) string {
 }
 
 func Signature(secret, method, path, body string, params map[string]string) string {
+	values := make(url.Values)
+	for k, v := range params {
+		values.Set(k, v)
+	}
+	return SignatureValues(secret, method, path, body, values)
+}
+
+// SignatureValues is like Signature, but takes the parameters as url.Values. Parameters with several
+// values contribute each of them, in sorted order.
+func SignatureValues(secret, method, path, body string, params url.Values) string {
 	exclude := []string{"signature"}
 	signature := secret + strings.ToUpper(method) + path + prepareQueryString(params, exclude) + body
 	h := sha256.New()
@@ -50,16 +76,120 @@ func Signature(secret, method, path, body string, params map[string]string) stri
 	return buf.String()[:43]
 }
 
-// Route needs leading slash, no trailing ?. Example: '/eventhub'
-// TODO: Make this less fragile.
-func SignRequest(route, apiKey, secret string) string {
-	expires := int(time.Now().Unix() + 300)
-	params := map[string]string{"api_key": apiKey, "expires": strconv.Itoa(expires)}
-	signature := Signature(secret, "GET", route, "", params)
-	params["signature"] = signature
-	var kv []string
-	for k, v := range params {
-		kv = append(kv, k+"="+v)
+// A Signer signs requests with an API key and secret.
+type Signer struct {
+	APIKey string
+	Secret string
+	// If set, the credentials are taken from here (each time a request is signed) instead of APIKey and
+	// Secret.
+	Source Source
+	// How long signatures are valid for. Zero means DefaultExpiry.
+	Expiry time.Duration
+	// Add a random nonce parameter, so that identical requests made within the same second are signed
+	// differently. Verifiers that reject replayed requests need this.
+	Nonce bool
+}
+
+func NewSigner(apiKey, secret string) *Signer {
+	return &Signer{APIKey: apiKey, Secret: secret}
+}
+
+// SignParams returns query plus the api_key, expires and signature parameters for a request. query may be
+// nil and is not modified.
+func (s *Signer) SignParams(method, path, body string, query url.Values) (url.Values, error) {
+	apiKey, secret := s.APIKey, s.Secret
+	if s.Source != nil {
+		var err error
+		if apiKey, secret, err = s.Source.Credentials(); err != nil {
+			return nil, err
+		}
 	}
-	return route + "?" + strings.Join(kv, "&")
+	expiry := s.Expiry
+	if expiry == 0 {
+		expiry = DefaultExpiry
+	}
+	params := make(url.Values)
+	for k, vs := range query {
+		params[k] = append([]string(nil), vs...)
+	}
+	params.Set("api_key", apiKey)
+	params.Set("expires", strconv.FormatInt(time.Now().Add(expiry).Unix(), 10))
+	if s.Nonce {
+		params.Set("nonce", newNonce())
+	}
+	params.Set("signature", SignatureValues(secret, method, path, body, params))
+	return params, nil
+}
+
+func newNonce() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// SignURL returns path with a signed (and properly escaped) query string appended. path needs a leading
+// slash and no query string of its own; pass any parameters in query instead.
+func (s *Signer) SignURL(method, path, body string, query url.Values) (string, error) {
+	params, err := s.SignParams(method, path, body, query)
+	if err != nil {
+		return "", err
+	}
+	return path + "?" + params.Encode(), nil
+}
+
+// Sign signs r in place, adding the signature parameters to its URL. If r has a body, it is read (and
+// replaced, so it can still be sent) in order to sign it.
+func (s *Signer) Sign(r *http.Request) error {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	params, err := s.SignParams(r.Method, r.URL.Path, string(body), r.URL.Query())
+	if err != nil {
+		return err
+	}
+	r.URL.RawQuery = params.Encode()
+	return nil
+}
+
+// Transport is an http.RoundTripper that signs every request before sending it with Base (or
+// http.DefaultTransport, if Base is nil).
+type Transport struct {
+	Signer *Signer
+	Base   http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// RoundTrippers mustn't modify the request they're given.
+	r2 := r.Clone(r.Context())
+	if err := t.Signer.Sign(r2); err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, err
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r2)
+}
+
+// SignRequest returns route with a signed query string for a GET request with no body. Route needs leading
+// slash, no trailing ?. Example: '/eventhub'
+func SignRequest(route, apiKey, secret string) string {
+	// Static credentials can't fail.
+	u, _ := NewSigner(apiKey, secret).SignURL("GET", route, "", nil)
+	return u
 }
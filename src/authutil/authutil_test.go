@@ -0,0 +1,178 @@
+package authutil
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// baselineSignature is how signatures were originally worked out, with one value per parameter.
+func baselineSignature(secret, method, path, body string, params map[string]string) string {
+	var keys []string
+	for k := range params {
+		if k != "signature" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	s := secret + method + path
+	for _, k := range keys {
+		s += k + "=" + params[k]
+	}
+	sum := sha256.Sum256([]byte(s + body))
+	return base64.URLEncoding.EncodeToString(sum[:])[:43]
+}
+
+func TestSignRequest(t *testing.T) {
+	signed := SignRequest("/eventhub", "key", "secret")
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/eventhub" {
+		t.Errorf("SignRequest() = %q", signed)
+	}
+	q := u.Query()
+	params := map[string]string{"api_key": q.Get("api_key"), "expires": q.Get("expires")}
+	if params["api_key"] != "key" || params["expires"] == "" || len(q) != 3 {
+		t.Fatalf("SignRequest() = %q", signed)
+	}
+	if got, want := q.Get("signature"), baselineSignature("secret", "GET", "/eventhub", "", params); got != want {
+		t.Errorf("signature %q; want %q", got, want)
+	}
+	if Signature("secret", "get", "/eventhub", "", params) != baselineSignature("secret", "GET", "/eventhub", "", params) {
+		t.Error("Signature doesn't match the baseline")
+	}
+}
+
+func TestSignURLEscaping(t *testing.T) {
+	s := NewSigner("key", "secret")
+	query := url.Values{
+		"q":     {"a&b=c d"},
+		"multi": {"2", "1"},
+		"plus":  {"1+1"},
+	}
+	signed, err := s.SignURL("GET", "/search", "", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(query["multi"], []string{"2", "1"}) {
+		t.Error("SignURL modified its query")
+	}
+	path, rawQuery, _ := strings.Cut(signed, "?")
+	if path != "/search" || strings.Contains(rawQuery, " ") || strings.Contains(rawQuery, "a&b") {
+		t.Fatalf("SignURL() = %q isn't escaped", signed)
+	}
+	// Keys come out sorted, and repeated keys keep their order.
+	if !strings.HasPrefix(rawQuery, "api_key=key&expires=") ||
+		!strings.Contains(rawQuery, "&multi=2&multi=1&plus=1%2B1&q=a%26b%3Dc+d&signature=") {
+		t.Errorf("SignURL() = %q", signed)
+	}
+	got, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, vs := range query {
+		if !reflect.DeepEqual(got[k], vs) {
+			t.Errorf("%s = %q after parsing; want %q", k, got[k], vs)
+		}
+	}
+	if !CheckSignature("secret", "GET", "/search", "", got.Get("signature"), got) {
+		t.Error("signature doesn't check out after parsing")
+	}
+
+	// The order of repeated values doesn't change the signature.
+	reordered := url.Values{}
+	for k, vs := range got {
+		reordered[k] = vs
+	}
+	reordered["multi"] = []string{"1", "2"}
+	if !CheckSignature("secret", "GET", "/search", "", got.Get("signature"), reordered) {
+		t.Error("reordering repeated values changed the signature")
+	}
+	reordered["multi"] = []string{"1", "3"}
+	if CheckSignature("secret", "GET", "/search", "", got.Get("signature"), reordered) {
+		t.Error("changing a repeated value didn't change the signature")
+	}
+}
+
+func TestSignBody(t *testing.T) {
+	s := NewSigner("key", "secret")
+	r, err := http.NewRequest("POST", "http://example.com/hooks?x=1", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sign(r); err != nil {
+		t.Fatal(err)
+	}
+	q := r.URL.Query()
+	if q.Get("x") != "1" || !CheckSignature("secret", "POST", "/hooks", "payload", q.Get("signature"), q) {
+		t.Errorf("bad signature on %s", r.URL)
+	}
+	for i := 0; i < 2; i++ {
+		body, err := r.GetBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadAll(body); string(b) != "payload" {
+			t.Errorf("GetBody() read %q", b)
+		}
+	}
+	if b, _ := ioutil.ReadAll(r.Body); string(b) != "payload" {
+		t.Errorf("Body read %q after signing", b)
+	}
+}
+
+func TestSignerSource(t *testing.T) {
+	s := &Signer{APIKey: "ignored", Source: Static{"key", "secret"}}
+	params, err := s.SignParams("GET", "/", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Get("api_key") != "key" || !CheckSignature("secret", "GET", "/", "", params.Get("signature"), params) {
+		t.Errorf("SignParams() = %v", params)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	v := NewVerifier("key", "secret")
+	srv := httptest.NewServer(v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})))
+	defer srv.Close()
+	client := &http.Client{Transport: &Transport{Signer: &Signer{APIKey: "key", Secret: "secret", Nonce: true}}}
+
+	r, err := http.NewRequest("POST", srv.URL+"/hooks?x=1", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "text/plain")
+	before := r.URL.String()
+	header := r.Header.Clone()
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			// Sending the same request again gets a new nonce, so it isn't taken for a replay.
+			r.Body, _ = r.GetBody()
+		}
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "payload" {
+			t.Errorf("got %s: %q", resp.Status, body)
+		}
+	}
+	if r.URL.String() != before || !reflect.DeepEqual(r.Header, header) {
+		t.Errorf("the caller's request was changed: %s %v", r.URL, r.Header)
+	}
+}
@@ -0,0 +1,113 @@
+package authutil
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A Source provides an API key and secret.
+type Source interface {
+	Credentials() (apiKey, secret string, err error)
+}
+
+// Static is a Source with fixed credentials.
+type Static struct {
+	APIKey string
+	Secret string
+}
+
+func (s Static) Credentials() (string, string, error) { return s.APIKey, s.Secret, nil }
+
+// EnvSource reads credentials from environment variables.
+type EnvSource struct {
+	APIKeyVar string
+	SecretVar string
+}
+
+func (s EnvSource) Credentials() (string, string, error) {
+	apiKey, secret := os.Getenv(s.APIKeyVar), os.Getenv(s.SecretVar)
+	if apiKey == "" || secret == "" {
+		return "", "", fmt.Errorf("$%s and $%s must both be set", s.APIKeyVar, s.SecretVar)
+	}
+	return apiKey, secret, nil
+}
+
+// FileSource reads credentials from a file containing the API key on the first line and the secret on the
+// second. The file must not be accessible to group or others.
+type FileSource struct {
+	Path string
+}
+
+func (s FileSource) Credentials() (string, string, error) {
+	if err := CheckPermissions(s.Path); err != nil {
+		return "", "", err
+	}
+	b, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return "", "", err
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		return "", "", fmt.Errorf("%s should contain an api key and a secret on separate lines", s.Path)
+	}
+	apiKey, secret := strings.TrimSpace(lines[0]), strings.TrimSpace(lines[1])
+	if apiKey == "" || secret == "" {
+		return "", "", fmt.Errorf("%s has an empty api key or secret", s.Path)
+	}
+	return apiKey, secret, nil
+}
+
+// CheckPermissions returns an error if the file at path can be read or written by anyone but its owner.
+func CheckPermissions(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("%s is accessible by other users (mode %#o); it should be 0600", path, perm)
+	}
+	return nil
+}
+
+// Cached remembers the credentials from another Source, so that it is only consulted when Reload is
+// called. It never returns an error itself.
+type Cached struct {
+	src Source
+
+	mu             sync.Mutex
+	apiKey, secret string
+}
+
+// NewCached loads the credentials from src.
+func NewCached(src Source) (*Cached, error) {
+	c := &Cached{src: src}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cached) Credentials() (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.apiKey, c.secret, nil
+}
+
+// Reload loads the credentials from the underlying source again. On failure, the old ones are kept.
+func (c *Cached) Reload() error {
+	apiKey, secret, err := c.src.Credentials()
+	if err != nil {
+		return err
+	}
+	if apiKey == "" || secret == "" {
+		return errors.New("empty api key or secret")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apiKey, c.secret = apiKey, secret
+	return nil
+}
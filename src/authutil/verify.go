@@ -0,0 +1,166 @@
+package authutil
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMissingParams = errors.New("request is not signed")
+	ErrUnknownKey    = errors.New("unknown api key")
+	ErrBadSignature  = errors.New("bad signature")
+	ErrExpired       = errors.New("signature has expired")
+	ErrTooFarAhead   = errors.New("signature expires too far in the future")
+	ErrReplayed      = errors.New("request has already been seen")
+	ErrBodyTooLarge  = errors.New("request body is too large")
+)
+
+// DefaultMaxBody is the largest request body a Verifier reads when it doesn't say otherwise.
+var DefaultMaxBody int64 = 1 << 20
+
+// CheckSignature reports whether signature is correct for a request. The comparison takes constant time.
+func CheckSignature(secret, method, path, body, signature string, params url.Values) bool {
+	expected := SignatureValues(secret, method, path, body, params)
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(signature)) == 1
+}
+
+// A Verifier checks the signatures of incoming requests.
+type Verifier struct {
+	// Lookup returns the secret for an API key.
+	Lookup func(apiKey string) (secret string, ok bool)
+	// How far our clock and the signer's may disagree
+	MaxSkew time.Duration
+	// The longest expiry accepted. Zero means DefaultExpiry.
+	MaxExpiry time.Duration
+	// If non-nil, each signature is only accepted once.
+	Nonces *NonceCache
+	// The largest request body accepted, in bytes. Zero means DefaultMaxBody.
+	MaxBody int64
+}
+
+// NewVerifier returns a Verifier for requests signed with a single key/secret pair, with replay protection
+// and a minute of allowed clock skew.
+func NewVerifier(apiKey, secret string) *Verifier {
+	return &Verifier{
+		Lookup: func(k string) (string, bool) {
+			return secret, k == apiKey
+		},
+		MaxSkew: time.Minute,
+		Nonces:  NewNonceCache(),
+	}
+}
+
+// Verify checks r's signature and returns the API key it was signed with. r's body, if any, is read in
+// order to check it, and replaced so it can still be read by the caller.
+func (v *Verifier) Verify(r *http.Request) (apiKey string, err error) {
+	params := r.URL.Query()
+	apiKey = params.Get("api_key")
+	signature := params.Get("signature")
+	if apiKey == "" || signature == "" || params.Get("expires") == "" {
+		return "", ErrMissingParams
+	}
+	secret, ok := v.Lookup(apiKey)
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	unix, err := strconv.ParseInt(params.Get("expires"), 10, 64)
+	if err != nil {
+		return "", ErrMissingParams
+	}
+	expires := time.Unix(unix, 0)
+	now := time.Now()
+	if now.After(expires.Add(v.MaxSkew)) {
+		return "", ErrExpired
+	}
+	maxExpiry := v.MaxExpiry
+	if maxExpiry == 0 {
+		maxExpiry = DefaultExpiry
+	}
+	if expires.After(now.Add(maxExpiry + v.MaxSkew)) {
+		return "", ErrTooFarAhead
+	}
+
+	var body []byte
+	if r.Body != nil {
+		// The api key isn't secret, so anyone could send a body; don't read more of it than we'll accept.
+		maxBody := v.MaxBody
+		if maxBody == 0 {
+			maxBody = DefaultMaxBody
+		}
+		body, err = ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxBody))
+		r.Body.Close()
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return "", ErrBodyTooLarge
+		}
+		if err != nil {
+			return "", err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if !CheckSignature(secret, r.Method, r.URL.Path, string(body), signature, params) {
+		return "", ErrBadSignature
+	}
+	// Only remember signatures that checked out, or anyone could use up the cache.
+	if v.Nonces != nil && !v.Nonces.Add(apiKey+" "+signature, expires.Add(v.MaxSkew)) {
+		return "", ErrReplayed
+	}
+	return apiKey, nil
+}
+
+// Middleware wraps h so that it only sees requests that pass Verify. Others get a 401 (or a 413 if the
+// body was too large).
+func (v *Verifier) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := v.Verify(r); err == ErrBodyTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// A NonceCache remembers values until they expire. Verifiers use it to reject replayed requests; since a
+// signature is useless after it expires, it only needs to be remembered until then.
+type NonceCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewNonceCache() *NonceCache {
+	return &NonceCache{seen: make(map[string]time.Time)}
+}
+
+// How often expired entries are cleared out of a NonceCache
+var nonceSweepInterval = time.Minute
+
+// Add records nonce, to be forgotten after expires. It returns false if nonce was already there.
+func (c *NonceCache) Add(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) > nonceSweepInterval {
+		for n, t := range c.seen {
+			if now.After(t) {
+				delete(c.seen, n)
+			}
+		}
+		c.lastSweep = now
+	}
+	if t, ok := c.seen[nonce]; ok && !now.After(t) {
+		return false
+	}
+	c.seen[nonce] = expires
+	return true
+}
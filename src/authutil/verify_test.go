@@ -0,0 +1,168 @@
+package authutil
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signed returns a request signed by s. Each call to the function it returns gives a fresh copy of the
+// request, after applying tamper to it if that's non-nil.
+func signed(t *testing.T, s *Signer, method, target, body string) func(tamper func(r *http.Request)) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if err := s.Sign(r); err != nil {
+		t.Fatal(err)
+	}
+	return func(tamper func(r *http.Request)) *http.Request {
+		r2 := httptest.NewRequest(method, r.URL.String(), strings.NewReader(body))
+		if tamper != nil {
+			tamper(r2)
+		}
+		return r2
+	}
+}
+
+func newTestVerifier() *Verifier {
+	return &Verifier{
+		Lookup: func(apiKey string) (string, bool) {
+			secret, ok := map[string]string{"key1": "secret1", "key2": "secret2"}[apiKey]
+			return secret, ok
+		},
+		MaxSkew: time.Minute,
+		Nonces:  NewNonceCache(),
+	}
+}
+
+func TestVerify(t *testing.T) {
+	signer := &Signer{APIKey: "key1", Secret: "secret1", Nonce: true}
+	for _, tt := range []struct {
+		name   string
+		signer *Signer
+		method string
+		body   string
+		tamper func(r *http.Request)
+		want   error
+	}{
+		{name: "get", signer: signer, method: "GET"},
+		{name: "post", signer: signer, method: "POST", body: `{"hello": "world"}`},
+		{name: "other key", signer: &Signer{APIKey: "key2", Secret: "secret2"}, method: "GET"},
+		{
+			name: "tampered body", signer: signer, method: "POST", body: "pay me $1",
+			tamper: func(r *http.Request) { r.Body = ioutil.NopCloser(strings.NewReader("pay me $1000")) },
+			want:   ErrBadSignature,
+		},
+		{
+			name: "tampered query", signer: signer, method: "GET",
+			tamper: func(r *http.Request) { r.URL.RawQuery += "&amount=1000" },
+			want:   ErrBadSignature,
+		},
+		{
+			name: "tampered path", signer: signer, method: "GET",
+			tamper: func(r *http.Request) { r.URL.Path = "/admin" },
+			want:   ErrBadSignature,
+		},
+		{
+			name: "tampered method", signer: signer, method: "GET",
+			tamper: func(r *http.Request) { r.Method = "DELETE" },
+			want:   ErrBadSignature,
+		},
+		{name: "wrong secret", signer: &Signer{APIKey: "key1", Secret: "secret2"}, method: "GET", want: ErrBadSignature},
+		{name: "unknown key", signer: &Signer{APIKey: "key3", Secret: "secret1"}, method: "GET", want: ErrUnknownKey},
+		{
+			name: "unsigned", signer: signer, method: "GET",
+			tamper: func(r *http.Request) { r.URL.RawQuery = "" },
+			want:   ErrMissingParams,
+		},
+		// Within the allowed skew is fine.
+		{name: "just expired", signer: &Signer{APIKey: "key1", Secret: "secret1", Expiry: -30 * time.Second}, method: "GET"},
+		{name: "expired", signer: &Signer{APIKey: "key1", Secret: "secret1", Expiry: -2 * time.Minute}, method: "GET", want: ErrExpired},
+		{name: "too far ahead", signer: &Signer{APIKey: "key1", Secret: "secret1", Expiry: time.Hour}, method: "GET", want: ErrTooFarAhead},
+		{
+			name: "too large", signer: signer, method: "POST", body: strings.Repeat("x", int(DefaultMaxBody)+1),
+			want: ErrBodyTooLarge,
+		},
+	} {
+		v := newTestVerifier()
+		r := signed(t, tt.signer, tt.method, "http://example.com/github?a=1&b=2", tt.body)(tt.tamper)
+		apiKey, err := v.Verify(r)
+		if err != tt.want {
+			t.Errorf("%s: Verify() returned error %v; want %v", tt.name, err, tt.want)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if apiKey != tt.signer.APIKey {
+			t.Errorf("%s: Verify() = %q; want %q", tt.name, apiKey, tt.signer.APIKey)
+		}
+		// The body can still be read.
+		if body, err := ioutil.ReadAll(r.Body); err != nil || string(body) != tt.body {
+			t.Errorf("%s: read %q, %v after verifying", tt.name, body, err)
+		}
+	}
+}
+
+func TestVerifyReplayed(t *testing.T) {
+	v := newTestVerifier()
+	req := signed(t, &Signer{APIKey: "key1", Secret: "secret1", Nonce: true}, "POST", "http://example.com/github", "body")
+	if _, err := v.Verify(req(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(req(nil)); err != ErrReplayed {
+		t.Fatalf("Verify() returned error %v for a replayed request; want %v", err, ErrReplayed)
+	}
+	// A request that fails the check doesn't use up its signature.
+	bad := signed(t, &Signer{APIKey: "key1", Secret: "secret1", Nonce: true}, "POST", "http://example.com/github", "body")
+	if _, err := v.Verify(bad(func(r *http.Request) { r.Body = ioutil.NopCloser(strings.NewReader("other")) })); err != ErrBadSignature {
+		t.Fatalf("Verify() returned error %v for a tampered request; want %v", err, ErrBadSignature)
+	}
+	if _, err := v.Verify(bad(nil)); err != nil {
+		t.Fatalf("Verify() returned error %v after a tampered copy was rejected", err)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	c := NewNonceCache()
+	now := time.Now()
+	if !c.Add("a", now.Add(time.Hour)) || !c.Add("b", now.Add(-time.Second)) {
+		t.Fatal("Add returned false for new nonces")
+	}
+	if c.Add("a", now.Add(time.Hour)) {
+		t.Error("Add returned true for a nonce that's already there")
+	}
+	// Expired nonces are forgotten.
+	if !c.Add("b", now.Add(time.Hour)) {
+		t.Error("Add returned false for a nonce that has expired")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	v := newTestVerifier()
+	v.MaxBody = 10
+	h := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	signer := &Signer{APIKey: "key1", Secret: "secret1", Nonce: true}
+	for _, tt := range []struct {
+		r    *http.Request
+		code int
+		body string
+	}{
+		{signed(t, signer, "POST", "http://example.com/", "hello")(nil), http.StatusOK, "hello"},
+		{httptest.NewRequest("POST", "http://example.com/", strings.NewReader("hello")), http.StatusUnauthorized, ""},
+		{signed(t, signer, "POST", "http://example.com/", "hello world!")(nil), http.StatusRequestEntityTooLarge, ""},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, tt.r)
+		if w.Code != tt.code {
+			t.Errorf("got status %d; want %d", w.Code, tt.code)
+		}
+		if tt.code == http.StatusOK && w.Body.String() != tt.body {
+			t.Errorf("handler got body %q; want %q", w.Body.String(), tt.body)
+		}
+	}
+}
@@ -1,5 +1,16 @@
 package bot
 
+import (
+	"command"
+	"connection"
+	"encoding/json"
+	"fmt"
+	"pratapi"
+	"protocol"
+	"scheduler"
+	"time"
+)
+
 type User struct {
 	Channels []string
 	Username string
@@ -8,18 +19,108 @@ type User struct {
 	Name     string
 }
 
+// UserFrom converts a user from the protocol package. A nil user gives an empty one.
+func UserFrom(u *protocol.User) *User {
+	if u == nil {
+		return &User{}
+	}
+	return &User{
+		Channels: u.Channels,
+		Username: u.Username,
+		Gravatar: u.Gravatar,
+		Email:    u.Email,
+		Name:     u.Name,
+	}
+}
+
 type UserInfo struct {
 	User *User
 }
 
+// Env is what a bot is given to work with when it's created.
+type Env struct {
+	Conn *connection.Conn
+	UI   *UserInfo
+	// Client for the server's REST API
+	API *pratapi.Client
+	// Bots add their chat commands here (see command.Registry.NewSet).
+	Commands *command.Registry
+	// Bots schedule timers here, with Owner set to their own name.
+	Scheduler *scheduler.Scheduler
+	// Bots publish custom events for each other here.
+	Bus Bus
+	// Bots that do things outside of Handle check here that they haven't been turned off.
+	Switches Switches
+
+	// Settings for particular bots (nil for the defaults)
+	Github *GithubOptions
+}
+
+// Switches says which bots have been turned off, or told not to hear from channels, while running (see
+// dispatcher.Dispatcher.Enable and EnableIn). Bots only need it for work that isn't prompted by an event,
+// since they don't get events they aren't meant to hear.
+type Switches interface {
+	// Hears reports whether the named bot is enabled and, unless channel is empty, hears from channel.
+	Hears(bot, channel string) bool
+}
+
+// A Bus carries custom events (see EventCustom) between bots.
+type Bus interface {
+	// Publish sends the event called name, e.g. "github.push", to every bot that subscribes to it except the
+	// one it's from. data is shared between the bots that get it, so none of them should modify it.
+	Publish(from, name string, data interface{})
+}
+
 type EventType int
 
 const (
 	_                      = iota // So that the uninitialized message isn't accidentally valid
 	EventConnect EventType = iota
 	EventPublishMessage
+	// The connection to the server was lost. Messages sent while disconnected are delivered after
+	// reconnection.
+	EventDisconnect
+	// The connection to the server was re-established after an EventDisconnect.
+	EventReconnect
+	// The bot process is shutting down. Bots should stop accepting new work; messages they send in response
+	// are still delivered if possible.
+	EventShutdown
+	// A user (possibly us) joined or left a channel.
+	EventJoinChannel
+	EventLeaveChannel
+	// A user came online or went offline.
+	EventUserActive
+	EventUserOffline
+	// A message from the server that we don't understand. The payload is an Unknown.
+	EventUnknown
+	// A job the bot scheduled with Env.Scheduler is due. The payload is a Timer.
+	EventTimer
+	// Another bot published an event on Env.Bus. The payload is a Custom.
+	EventCustom
 )
 
+var eventTypeNames = map[EventType]string{
+	EventConnect:        "connect",
+	EventPublishMessage: "publish_message",
+	EventDisconnect:     "disconnect",
+	EventReconnect:      "reconnect",
+	EventShutdown:       "shutdown",
+	EventJoinChannel:    "join_channel",
+	EventLeaveChannel:   "leave_channel",
+	EventUserActive:     "user_active",
+	EventUserOffline:    "user_offline",
+	EventUnknown:        "unknown",
+	EventTimer:          "timer",
+	EventCustom:         "custom",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
 // Events should not be modified by bots.
 type Event struct {
 	// Type indicates the contents of Payload, which might be nil.
@@ -33,8 +134,20 @@ type Bot interface {
 	Handle(e *Event)
 }
 
-type MessageType struct {
-	Type string `json:"action"`
+// A Subscriber is a Bot that only wants some events. Bots that aren't Subscribers get all of them.
+type Subscriber interface {
+	Bot
+	Subscription() *Subscription
+}
+
+type Subscription struct {
+	// The event types to deliver. Empty means all of them.
+	Types []EventType
+	// The channels to deliver messages, joins and leaves from, either as names or as patterns like
+	// "bot-*" (see path.Match). Empty means all channels. The named channels are joined on connect.
+	Channels []string
+	// The custom events to deliver, either as names or as patterns like "github.*". Empty means all of them.
+	Events []string
 }
 
 type PublishMessage struct {
@@ -45,3 +158,54 @@ type PublishMessage struct {
 		Message  string
 	}
 }
+
+type JoinChannel struct {
+	Data struct {
+		User    *User
+		Channel string
+	}
+}
+
+type LeaveChannel struct {
+	Data struct {
+		User    *User
+		Channel string
+	}
+}
+
+type UserActive struct {
+	Data struct {
+		User *User
+	}
+}
+
+type UserOffline struct {
+	Data struct {
+		User *User
+	}
+}
+
+// Unknown is a message with an action we don't know about. Data is its raw JSON data.
+type Unknown struct {
+	Action string
+	Data   json.RawMessage
+}
+
+// Timer is the payload of EventTimer.
+type Timer struct {
+	// The job's ID and data, as scheduled
+	ID   string
+	Data string
+	// When the job was due
+	Time time.Time
+}
+
+// Custom is the payload of EventCustom.
+type Custom struct {
+	// The bot that published the event
+	From string
+	// What happened, e.g. "github.push" or "deploy.finished"
+	Name string
+	// Whatever the publisher wants to say about it; see the publishing bot for what it is.
+	Data interface{}
+}
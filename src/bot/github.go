@@ -4,21 +4,38 @@ package bot
 // TODO: Listen for other events (e.g., new issues, pull requests, comments, etc).
 
 import (
+	"authutil"
 	"bytes"
+	"command"
 	"connection"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
-const (
-	addr = "localhost:9898"
-)
+// GithubOptions configures the Github bot for one connection.
+type GithubOptions struct {
+	// Where to listen for notifications. Each connection running the bot needs its own address.
+	Addr string `json:"addr"`
+	// api key -> secret. If there are any, notifications must be signed with one of these, the same way
+	// requests to Prat are signed (see authutil.Verifier). Github can't sign requests like that itself, so
+	// this only works with a relay that receives Github's webhooks, checks them, and signs them on the way
+	// to us.
+	WebhookKeys map[string]string `json:"webhookkeys"`
+}
+
+var DefaultGithubAddr = "localhost:9898"
+
+// Where issues are looked up
+var GithubAPI = "https://api.github.com"
 
 // TODO: configuration for bots should probably be in config files
 var config = struct {
@@ -28,7 +45,7 @@ var config = struct {
 	Issues map[string]string
 }{
 	Notifications: map[string][]string{
-		"prat":  {"general", "prat"},
+		"prat":    {"general", "prat"},
 		"barkeep": {"barkeep"},
 		"pratbot": {"pratbot", "bot-test"},
 	},
@@ -102,8 +119,14 @@ var messageTemplate = `
 {{end}}
 `
 
-func NotificationHandler(conn *connection.Conn) http.HandlerFunc {
+// NotificationHandler posts notifications to the channels for the repository, and publishes each one as a
+// "github.push" event, with the GithubNotification as its data. Nothing is done while the bot is disabled,
+// and nothing is posted to channels it's been told not to hear from.
+func (b *Github) NotificationHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !b.hears("") {
+			return
+		}
 		r.ParseForm()
 		payload := r.Form["payload"]
 		if len(payload) < 1 || payload[0] == "" {
@@ -115,6 +138,9 @@ func NotificationHandler(conn *connection.Conn) http.HandlerFunc {
 			log.Println("GithubBot warning: couldn't parse payload:", payload)
 			return
 		}
+		if b.bus != nil {
+			b.bus.Publish("github", "github.push", &notification)
+		}
 		var buf bytes.Buffer
 		if err := templ.Execute(&buf, &notification); err != nil {
 			log.Println("GithubBot warning: couldn't construct message", err)
@@ -122,28 +148,72 @@ func NotificationHandler(conn *connection.Conn) http.HandlerFunc {
 		}
 		message := strings.TrimSpace(buf.String())
 		for _, c := range config.Notifications[notification.Repository.Name] {
-			conn.SendMessage(c, message)
+			if !b.hears(c) {
+				continue
+			}
+			r, err := b.conn.SendMessageAck(c, message)
+			if err != nil {
+				log.Println("GithubBot warning: couldn't send notification:", err)
+				continue
+			}
+			go reportDelivery(c, r)
 		}
 	}
 }
 
+// How long to wait for a notification to show up in a channel before complaining.
+const deliveryTimeout = 5 * time.Minute
+
+func reportDelivery(channel string, r *connection.Receipt) {
+	if err := r.Wait(deliveryTimeout); err != nil {
+		log.Printf("GithubBot warning: notification to %s may not have been delivered: %s", channel, err)
+	}
+}
+
 type Github struct {
-	conn *connection.Conn
-	ui   *UserInfo
+	opts     GithubOptions
+	conn     *connection.Conn
+	bus      Bus
+	switches Switches
+	commands *command.Set
+	// Listener for the notification server
+	ln net.Listener
+}
+
+func NewGithub(env *Env) Bot {
+	b := &Github{conn: env.Conn, bus: env.Bus, switches: env.Switches}
+	if env.Github != nil {
+		b.opts = *env.Github
+	}
+	if b.opts.Addr == "" {
+		b.opts.Addr = DefaultGithubAddr
+	}
+	b.commands = env.Commands.NewSet("github", b.Send)
+	var issueChannels []string
+	for c := range config.Issues {
+		issueChannels = append(issueChannels, c)
+	}
+	b.commands.Add(&command.Command{
+		Name:     "issue",
+		Help:     "Look up a Github issue.",
+		Args:     []command.Arg{{Name: "owner/repo", Optional: true}, {Name: "number"}},
+		Channels: issueChannels,
+		Run:      b.IssueLookup,
+	})
+	return b
 }
 
-func NewGithub(conn *connection.Conn, ui *UserInfo) Bot {
-	return &Github{conn, ui}
+// hears reports whether the bot is enabled and hears from channel (see Switches).
+func (b *Github) hears(channel string) bool {
+	return b.switches == nil || b.switches.Hears("github", channel)
 }
 
 func (b *Github) Send(channel, msg string) {
 	b.conn.SendMessage(channel, "**[GithubBot]** "+msg)
 }
 
-func (b *Github) SendIssueError(channel, msg string) {
-	msg = "**error:** " + msg + " (hint: try '!issue <commit>' or '!issue <user>/<repo> <commit>')"
-	b.Send(channel, msg)
-}
+// For looking up issues. Without a timeout, a request that hangs would stop the bot handling anything else.
+var githubClient = &http.Client{Timeout: 10 * time.Second}
 
 type issueResponse struct {
 	Url   string `json:"html_url"`
@@ -151,86 +221,90 @@ type issueResponse struct {
 	Title string
 }
 
-func (b *Github) IssueLookup(channel, msg string) {
-	parts := strings.Split(msg, " ")
-	repo := config.Issues[channel]
-	var issue string
-	switch len(parts) {
-	case 1:
-		issue = parts[0]
-	case 2:
-		repo = parts[0]
-		issue = parts[1]
-	default:
-		b.SendIssueError(channel, "bad input.")
-		return
+func (b *Github) IssueLookup(c *command.Context) error {
+	repo := c.Arg("owner/repo")
+	if repo == "" {
+		repo = config.Issues[c.Channel]
 	}
 	repoParts := strings.SplitN(repo, "/", 2)
 	if len(repoParts) != 2 {
-		b.SendIssueError(channel, "Bad repo (should be owner/repo): "+repo)
-		return
+		return command.Usagef("bad repo (should be owner/repo): %s", repo)
 	}
 	owner, repo := repoParts[0], repoParts[1]
-	issueNumber, err := strconv.Atoi(issue)
+	issueNumber, err := strconv.Atoi(c.Arg("number"))
 	if err != nil {
-		b.SendIssueError(channel, "Bad issue (should be a number): "+issue)
-		return
+		return command.Usagef("bad issue (should be a number): %s", c.Arg("number"))
 	}
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/issues/%d", owner, repo, issueNumber)
-	resp, err := http.Get(url)
+	url := fmt.Sprintf("%s/repos/%s/%s/issues/%d", GithubAPI, owner, repo, issueNumber)
+	resp, err := githubClient.Get(url)
 	if err != nil {
-		b.SendIssueError(channel, "Error fetching issue info.")
-		return
+		return errors.New("couldn't fetch issue info")
 	}
+	defer resp.Body.Close()
 	switch resp.StatusCode {
 	case 200:
 	case 404:
-		b.Send(channel, "No such issue.")
-		return
+		c.Reply("No such issue.")
+		return nil
 	default:
-		b.SendIssueError(channel, "Error fetching issue info.")
-		return
+		return errors.New("couldn't fetch issue info")
 	}
 	r := &issueResponse{}
 	var buf bytes.Buffer
 	io.Copy(&buf, resp.Body)
 	err = json.Unmarshal(buf.Bytes(), r)
 	if err != nil {
-		b.SendIssueError(channel, "Error decoding issue info.")
-		return
+		return errors.New("couldn't decode issue info")
 	}
 	responseMsg := fmt.Sprintf(`[Issue #%d in %s/%s:](%s) %s **[%s]**`,
 		issueNumber, owner, repo, r.Url, r.Title, r.State)
-	b.Send(channel, responseMsg)
+	c.Reply(responseMsg)
+	return nil
+}
+
+func (b *Github) Subscription() *Subscription {
+	// We don't really need to join the notification channels, but whatever.
+	sub := &Subscription{
+		Types: []EventType{EventConnect, EventShutdown, EventPublishMessage},
+	}
+	for c := range chans {
+		sub.Channels = append(sub.Channels, c)
+	}
+	return sub
 }
 
 func (b *Github) Handle(e *Event) {
 	switch e.Type {
 	case EventConnect:
-		// We don't really need to join these channels, but whatever.
-		for c, _ := range chans {
-			b.conn.Join(c)
-		}
-
 		// Start server
-		mux := http.NewServeMux()
-		mux.HandleFunc("/", NotificationHandler(b.conn))
-		go http.ListenAndServe(addr, mux)
-	case EventPublishMessage:
-		m := e.Payload.(PublishMessage)
-		// Ignore our own message.
-		if m.Data.User.Email == b.ui.User.Email {
+		ln, err := net.Listen("tcp", b.opts.Addr)
+		if err != nil {
+			log.Println("GithubBot warning: couldn't start notification server:", err)
 			return
 		}
-
-		// Respond to issue requests
-		prefix := "!issue"
-		if strings.HasPrefix(m.Data.Message, prefix) {
-			for channel := range config.Issues {
-				if channel == m.Data.Channel {
-					b.IssueLookup(channel, strings.TrimSpace(m.Data.Message[len(prefix):]))
-				}
+		b.ln = ln
+		var handler http.Handler = b.NotificationHandler()
+		if len(b.opts.WebhookKeys) > 0 {
+			v := &authutil.Verifier{
+				Lookup: func(apiKey string) (string, bool) {
+					secret, ok := b.opts.WebhookKeys[apiKey]
+					return secret, ok
+				},
+				MaxSkew: time.Minute,
+				Nonces:  authutil.NewNonceCache(),
 			}
+			handler = v.Middleware(handler)
 		}
+		mux := http.NewServeMux()
+		mux.Handle("/", handler)
+		go http.Serve(ln, mux)
+	case EventShutdown:
+		// Stop accepting notifications.
+		if b.ln != nil {
+			b.ln.Close()
+		}
+	case EventPublishMessage:
+		m := e.Payload.(PublishMessage)
+		b.commands.Handle(m.Data.Channel, m.Data.User.Username, m.Data.Message)
 	}
 }
@@ -0,0 +1,59 @@
+package bot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestShorten(t *testing.T) {
+	if got := shortenSha("0123456789abcdef"); got != "01234567" {
+		t.Errorf("shortenSha() = %q", got)
+	}
+	for _, tt := range []struct{ msg, want string }{
+		{"Fix it", "Fix it"},
+		{"Fix it\n\nAt length.", "Fix it"},
+		{strings.Repeat("a", 80), strings.Repeat("a", 80)},
+		{strings.Repeat("a", 81), strings.Repeat("a", 77) + "..."},
+	} {
+		if got := shortenMessage(tt.msg); got != tt.want {
+			t.Errorf("shortenMessage(%q) = %q; want %q", tt.msg, got, tt.want)
+		}
+	}
+}
+
+type testSwitches map[string]bool
+
+func (s testSwitches) Hears(bot, channel string) bool { return s[channel] }
+
+type testBus []string
+
+func (b *testBus) Publish(from, name string, data interface{}) { *b = append(*b, from+" "+name) }
+
+// Notifications aren't posted (or published) by a disabled bot, or posted in channels it doesn't hear from.
+// (Posting would fail, since there's no connection.)
+func TestNotificationSwitches(t *testing.T) {
+	payload := url.Values{"payload": {`{"repository": {"name": "pratbot"}, "commits": []}`}}
+	for _, tt := range []struct {
+		switches  testSwitches
+		published []string
+	}{
+		{testSwitches{}, nil},
+		{testSwitches{"": true}, []string{"github github.push"}},
+	} {
+		var bus testBus
+		b := &Github{bus: &bus, switches: tt.switches}
+		r := httptest.NewRequest("POST", "/", strings.NewReader(payload.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		b.NotificationHandler()(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("got status %d", w.Code)
+		}
+		if strings.Join(bus, ",") != strings.Join(tt.published, ",") {
+			t.Errorf("with %v, published %q; want %q", tt.switches, bus, tt.published)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package bot
+
+import (
+	"command"
+)
+
+// Help answers !help with the commands of all the bots.
+type Help struct {
+	commands *command.Registry
+}
+
+func NewHelp(env *Env) Bot {
+	return &Help{env.Commands}
+}
+
+func (b *Help) Subscription() *Subscription {
+	return &Subscription{Types: []EventType{EventPublishMessage}}
+}
+
+func (b *Help) Handle(e *Event) {
+	m := e.Payload.(PublishMessage)
+	b.commands.Handle(m.Data.Channel, m.Data.User.Username, m.Data.Message)
+}
@@ -0,0 +1,422 @@
+// Package command parses chat commands like "!issue bkad/prat 12" and runs them.
+//
+// Each bot adds its commands to its own Set, and passes the messages it hears to Set.Handle. The Sets of
+// all the bots on a connection belong to a Registry, which answers !help for all of them.
+package command
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Commands are messages that start with Prefix followed by the command name.
+var Prefix = "!"
+
+type Command struct {
+	Name    string
+	Aliases []string
+	// One-line description for !help
+	Help  string
+	Args  []Arg
+	Flags []Flag
+	// The channels (names or patterns, see path.Match) the command works in. Empty means all of them.
+	Channels []string
+	Run      func(c *Context) error
+}
+
+// An Arg is a positional argument. When there are fewer arguments than Args, the optional ones are left
+// empty (starting from the last), wherever they are.
+type Arg struct {
+	Name     string
+	Optional bool
+	// Takes all the remaining arguments, joined by spaces. Only for the last Arg.
+	Rest bool
+}
+
+// A Flag is given as -name, or -name=value (or -name value) if it takes a value. Flags may appear anywhere
+// before "--". Other words starting with "-", like "-5", are arguments.
+type Flag struct {
+	Name     string
+	Help     string
+	HasValue bool
+}
+
+// Usage returns a synopsis of the command, e.g. "!issue [-v] [repo] <number>".
+func (c *Command) Usage() string {
+	parts := []string{Prefix + c.Name}
+	for _, f := range c.Flags {
+		if f.HasValue {
+			parts = append(parts, fmt.Sprintf("[-%s=<%s>]", f.Name, f.Name))
+		} else {
+			parts = append(parts, fmt.Sprintf("[-%s]", f.Name))
+		}
+	}
+	for _, a := range c.Args {
+		name := a.Name
+		if a.Rest {
+			name += "..."
+		}
+		if a.Optional {
+			parts = append(parts, "["+name+"]")
+		} else {
+			parts = append(parts, "<"+name+">")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (c *Command) enabledIn(channel string) bool {
+	if len(c.Channels) == 0 {
+		return true
+	}
+	for _, p := range c.Channels {
+		if ok, _ := path.Match(p, channel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Command) flag(name string) *Flag {
+	for i := range c.Flags {
+		if c.Flags[i].Name == name {
+			return &c.Flags[i]
+		}
+	}
+	return nil
+}
+
+// A Context is what a command's Run function gets to work with.
+type Context struct {
+	Command  *Command
+	Channel  string
+	Username string
+	args     map[string]string
+	flags    map[string]string
+	send     func(channel, msg string)
+}
+
+// Arg returns the named argument, or "" if it wasn't given.
+func (c *Context) Arg(name string) string { return c.args[name] }
+
+// Flag returns the value of the named flag and whether it was given. Flags without values are "".
+func (c *Context) Flag(name string) (string, bool) {
+	v, ok := c.flags[name]
+	return v, ok
+}
+
+// Reply sends msg to the channel the command came from.
+func (c *Context) Reply(msg string) { c.send(c.Channel, msg) }
+
+// A UsageError means a command was used wrong. Its reply includes the usage.
+type UsageError struct {
+	Message string
+}
+
+func (e *UsageError) Error() string { return e.Message }
+
+// Usagef returns a *UsageError.
+func Usagef(format string, args ...interface{}) error {
+	return &UsageError{fmt.Sprintf(format, args...)}
+}
+
+// Split breaks a command line into words at spaces. Words may be quoted with double quotes, or single quotes
+// at the start of a word (so that apostrophes, as in "don't", are left alone), to include spaces; within
+// double quotes, a backslash escapes the next character.
+func Split(line string) ([]string, error) {
+	var words []string
+	var word []rune
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word = append(word, r)
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word = append(word, r)
+		case r == '"' || (r == '\'' && !inWord):
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, string(word))
+				word = word[:0]
+				inWord = false
+			}
+		default:
+			word = append(word, r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
+
+// parse splits text into a command name and the words after it. ok is false if text isn't a command.
+func parse(text string) (name, rest string, ok bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, Prefix) {
+		return "", "", false
+	}
+	text = text[len(Prefix):]
+	i := strings.IndexAny(text, " \t\n")
+	if i < 0 {
+		name = text
+	} else {
+		name, rest = text[:i], text[i+1:]
+	}
+	if name == "" {
+		return "", "", false
+	}
+	return name, rest, true
+}
+
+// bind fills in c's arguments and flags from words.
+func (c *Context) bind(words []string) error {
+	cmd := c.Command
+	var positional []string
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		if w == "--" {
+			positional = append(positional, words[i+1:]...)
+			break
+		}
+		if len(w) < 2 || w[0] != '-' {
+			positional = append(positional, w)
+			continue
+		}
+		name, value := w[1:], ""
+		hasValue := false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+		f := cmd.flag(name)
+		if f == nil {
+			positional = append(positional, w)
+			continue
+		}
+		if f.HasValue && !hasValue {
+			if i+1 == len(words) {
+				return Usagef("-%s needs a value", name)
+			}
+			i++
+			value = words[i]
+		}
+		if !f.HasValue && hasValue {
+			return Usagef("-%s doesn't take a value", name)
+		}
+		c.flags[name] = value
+	}
+
+	required := 0
+	rest := false
+	for _, a := range cmd.Args {
+		if !a.Optional {
+			required++
+		}
+		rest = rest || a.Rest
+	}
+	if len(positional) < required {
+		return Usagef("not enough arguments")
+	}
+	if len(positional) > len(cmd.Args) && !rest {
+		return Usagef("too many arguments")
+	}
+	// The number of optional arguments we have values for
+	optional := len(positional) - required
+	for _, a := range cmd.Args {
+		if len(positional) == 0 {
+			break
+		}
+		if a.Optional {
+			if optional == 0 {
+				continue
+			}
+			optional--
+		}
+		if a.Rest {
+			c.args[a.Name] = strings.Join(positional, " ")
+			break
+		}
+		c.args[a.Name] = positional[0]
+		positional = positional[1:]
+	}
+	return nil
+}
+
+// A Set is one bot's commands.
+type Set struct {
+	owner string
+	send  func(channel, msg string)
+
+	mu       sync.Mutex
+	commands map[string]*Command
+	// In the order they were added, without aliases
+	ordered []*Command
+}
+
+// Add adds c to the set. It panics if the name or one of the aliases is already taken.
+func (s *Set) Add(c *Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range append([]string{c.Name}, c.Aliases...) {
+		if _, ok := s.commands[name]; ok {
+			panic("command: duplicate command " + name)
+		}
+		s.commands[name] = c
+	}
+	s.ordered = append(s.ordered, c)
+}
+
+func (s *Set) lookup(name string) *Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands[name]
+}
+
+func (s *Set) list() []*Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Command(nil), s.ordered...)
+}
+
+// Handle runs the command in text, if it's one of ours and enabled in channel. It reports whether it was.
+func (s *Set) Handle(channel, username, text string) bool {
+	name, rest, ok := parse(text)
+	if !ok {
+		return false
+	}
+	cmd := s.lookup(name)
+	if cmd == nil || !cmd.enabledIn(channel) {
+		return false
+	}
+	c := &Context{
+		Command:  cmd,
+		Channel:  channel,
+		Username: username,
+		args:     make(map[string]string),
+		flags:    make(map[string]string),
+		send:     s.send,
+	}
+	words, err := Split(rest)
+	if err == nil {
+		err = c.bind(words)
+	}
+	if err == nil {
+		err = cmd.Run(c)
+	}
+	if err != nil {
+		msg := "**error:** " + err.Error()
+		if _, ok := err.(*UsageError); ok {
+			msg += " (usage: `" + cmd.Usage() + "`)"
+		}
+		c.Reply(msg)
+	}
+	return true
+}
+
+// A Registry holds the command sets of all the bots on a connection.
+type Registry struct {
+	send func(channel, msg string)
+
+	mu    sync.Mutex
+	sets  []*Set
+	hears func(owner, channel string) bool
+}
+
+// NewRegistry returns a registry that uses send to answer !help.
+func NewRegistry(send func(channel, msg string)) *Registry {
+	return &Registry{send: send}
+}
+
+// SetHears makes !help leave out the commands of bots for which hears(owner, channel) is false, such as
+// bots that have been turned off (see bot.Switches).
+func (r *Registry) SetHears(hears func(owner, channel string) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hears = hears
+}
+
+// NewSet returns an empty set of commands for the bot called owner. Replies are sent with send, or the
+// registry's own send function if it's nil.
+func (r *Registry) NewSet(owner string, send func(channel, msg string)) *Set {
+	if send == nil {
+		send = r.send
+	}
+	s := &Set{owner: owner, send: send, commands: make(map[string]*Command)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sets = append(r.sets, s)
+	return s
+}
+
+// Handle answers text if it's a !help command. It reports whether it was.
+func (r *Registry) Handle(channel, username, text string) bool {
+	name, rest, ok := parse(text)
+	if !ok || name != "help" {
+		return false
+	}
+	r.mu.Lock()
+	all, hears := r.sets, r.hears
+	r.mu.Unlock()
+	var sets []*Set
+	for _, s := range all {
+		if hears == nil || hears(s.owner, channel) {
+			sets = append(sets, s)
+		}
+	}
+
+	topic := strings.TrimPrefix(strings.TrimSpace(rest), Prefix)
+	if topic != "" {
+		for _, s := range sets {
+			if cmd := s.lookup(topic); cmd != nil && cmd.enabledIn(channel) {
+				r.send(channel, commandHelp(s.owner, cmd))
+				return true
+			}
+		}
+		r.send(channel, fmt.Sprintf("No command %s%s here.", Prefix, topic))
+		return true
+	}
+
+	var lines []string
+	for _, s := range sets {
+		for _, cmd := range s.list() {
+			if cmd.enabledIn(channel) {
+				lines = append(lines, fmt.Sprintf("`%s` %s", cmd.Usage(), cmd.Help))
+			}
+		}
+	}
+	if len(lines) == 0 {
+		r.send(channel, "No commands here.")
+		return true
+	}
+	sort.Strings(lines)
+	r.send(channel, "Commands:\n"+strings.Join(lines, "\n"))
+	return true
+}
+
+func commandHelp(owner string, cmd *Command) string {
+	lines := []string{fmt.Sprintf("`%s` %s (from the %s bot)", cmd.Usage(), cmd.Help, owner)}
+	if len(cmd.Aliases) > 0 {
+		lines = append(lines, "Also: "+Prefix+strings.Join(cmd.Aliases, ", "+Prefix))
+	}
+	for _, f := range cmd.Flags {
+		lines = append(lines, fmt.Sprintf("`-%s` %s", f.Name, f.Help))
+	}
+	return strings.Join(lines, "\n")
+}
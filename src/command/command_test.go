@@ -0,0 +1,137 @@
+package command
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"  a  b\tc ", []string{"a", "b", "c"}},
+		{`say "hello world"`, []string{"say", "hello world"}},
+		{`say 'hello world'`, []string{"say", "hello world"}},
+		{`say "a \"quoted\" word"`, []string{"say", `a "quoted" word`}},
+		{`say 'single \ quotes'`, []string{"say", `single \ quotes`}},
+		{`say "it's"`, []string{"say", "it's"}},
+		{`say ""`, []string{"say", ""}},
+		{`a"b c"d`, []string{"ab cd"}},
+		// Apostrophes inside words aren't quotes.
+		{"don't do that", []string{"don't", "do", "that"}},
+		{"the bots' channels", []string{"the", "bots'", "channels"}},
+		{`'quoted' isn't`, []string{"quoted", "isn't"}},
+	} {
+		got, err := Split(tt.line)
+		if err != nil {
+			t.Errorf("Split(%q): %s", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Split(%q) = %q; want %q", tt.line, got, tt.want)
+		}
+	}
+	for _, line := range []string{`say "unterminated`, `say 'unterminated`, `say "trailing\`} {
+		if _, err := Split(line); err == nil {
+			t.Errorf("Split(%q): expected an error", line)
+		}
+	}
+}
+
+// run handles text with a set holding cmd, and returns the arguments and flags it was run with, or the
+// reply if it failed.
+func run(cmd *Command, text string) (args, flags map[string]string, reply string) {
+	var replies []string
+	r := NewRegistry(nil)
+	s := r.NewSet("test", func(channel, msg string) { replies = append(replies, msg) })
+	cmd.Run = func(c *Context) error {
+		args, flags = c.args, c.flags
+		return nil
+	}
+	s.Add(cmd)
+	if !s.Handle("general", "alice", text) {
+		return nil, nil, "(not handled)"
+	}
+	return args, flags, strings.Join(replies, "\n")
+}
+
+func TestArgs(t *testing.T) {
+	issue := &Command{
+		Name:  "issue",
+		Args:  []Arg{{Name: "repo", Optional: true}, {Name: "number"}},
+		Flags: []Flag{{Name: "v"}, {Name: "format", HasValue: true}},
+	}
+	add := &Command{
+		Name: "add",
+		Args: []Arg{{Name: "a"}, {Name: "b"}},
+	}
+	echo := &Command{
+		Name: "echo",
+		Args: []Arg{{Name: "text", Rest: true}},
+	}
+	for _, tt := range []struct {
+		cmd   *Command
+		text  string
+		args  map[string]string
+		flags map[string]string
+		reply string
+	}{
+		{cmd: issue, text: "!issue 12", args: map[string]string{"number": "12"}},
+		{cmd: issue, text: "!issue bkad/prat 12", args: map[string]string{"repo": "bkad/prat", "number": "12"}},
+		{cmd: issue, text: "!issue -v 12", args: map[string]string{"number": "12"}, flags: map[string]string{"v": ""}},
+		{cmd: issue, text: "!issue 12 -format=short", args: map[string]string{"number": "12"}, flags: map[string]string{"format": "short"}},
+		{cmd: issue, text: "!issue -format short 12", args: map[string]string{"number": "12"}, flags: map[string]string{"format": "short"}},
+		{cmd: issue, text: "!issue -- -v", args: map[string]string{"number": "-v"}},
+		// Words that aren't declared flags are arguments.
+		{cmd: add, text: "!add 1 -5", args: map[string]string{"a": "1", "b": "-5"}},
+		{cmd: add, text: "!add -x -", args: map[string]string{"a": "-x", "b": "-"}},
+		{cmd: issue, text: "!issue -12", args: map[string]string{"number": "-12"}},
+		{cmd: echo, text: "!echo don't -stop me now", args: map[string]string{"text": "don't -stop me now"}},
+
+		{cmd: issue, text: "!issue", reply: "**error:** not enough arguments (usage: `!issue [-v] [-format=<format>] [repo] <number>`)"},
+		{cmd: issue, text: "!issue a b c", reply: "**error:** too many arguments (usage: `!issue [-v] [-format=<format>] [repo] <number>`)"},
+		{cmd: issue, text: "!issue 12 -format", reply: "**error:** -format needs a value (usage: `!issue [-v] [-format=<format>] [repo] <number>`)"},
+		{cmd: issue, text: "!issue 12 -v=1", reply: "**error:** -v doesn't take a value (usage: `!issue [-v] [-format=<format>] [repo] <number>`)"},
+		{cmd: add, text: `!add "1 2`, reply: "**error:** unterminated quote"},
+	} {
+		args, flags, reply := run(tt.cmd, tt.text)
+		if tt.reply != "" || reply != "" {
+			if reply != tt.reply {
+				t.Errorf("%s: replied %q; want %q", tt.text, reply, tt.reply)
+			}
+			continue
+		}
+		if tt.args == nil {
+			tt.args = map[string]string{}
+		}
+		if tt.flags == nil {
+			tt.flags = map[string]string{}
+		}
+		if !reflect.DeepEqual(args, tt.args) || !reflect.DeepEqual(flags, tt.flags) {
+			t.Errorf("%s: got args %v, flags %v; want %v, %v", tt.text, args, flags, tt.args, tt.flags)
+		}
+	}
+}
+
+func TestHelpHears(t *testing.T) {
+	var replies []string
+	r := NewRegistry(func(channel, msg string) { replies = append(replies, msg) })
+	r.NewSet("on", nil).Add(&Command{Name: "shown", Help: "Shown."})
+	r.NewSet("off", nil).Add(&Command{Name: "hidden", Help: "Hidden."})
+	r.SetHears(func(owner, channel string) bool { return owner == "on" || channel == "special" })
+
+	r.Handle("general", "alice", "!help")
+	r.Handle("general", "alice", "!help hidden")
+	r.Handle("special", "alice", "!help")
+	want := []string{
+		"Commands:\n`!shown` Shown.",
+		"No command !hidden here.",
+		"Commands:\n`!hidden` Hidden.\n`!shown` Shown.",
+	}
+	if !reflect.DeepEqual(replies, want) {
+		t.Errorf("replied %q; want %q", replies, want)
+	}
+}
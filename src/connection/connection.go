@@ -1,158 +1,624 @@
 package connection
 
 import (
-	"code.google.com/p/go.net/websocket"
-	"crypto/tls"
-	"encoding/json"
+	"code.google.com/p/go.net/proxy"
+	"errors"
 	"log"
+	"math/rand"
+	"sort"
+	"sync"
 	"time"
 
 	"authutil"
+	"protocol"
 )
 
+// These are read when a connection is made; changing them doesn't affect existing connections.
 var (
 	PingFrequency = 30 * time.Second
-	// TODO: exponential backoff
-	ReconnectFrequency = 10 * time.Second
+	// The connection is considered dead once this many pings in a row have gone unanswered.
+	MaxMissedPongs = 3
+	// Reconnection attempts back off exponentially from ReconnectMinDelay up to ReconnectMaxDelay. Each
+	// delay is randomized to somewhere between half and all of its nominal value.
+	ReconnectMinDelay = 1 * time.Second
+	ReconnectMaxDelay = 2 * time.Minute
 )
 
+var ErrClosed = errors.New("connection closed")
+
+type State int
+
+const (
+	StateConnecting State = iota
+	StateConnected
+	StateDisconnected
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
 func (c *Conn) receive() {
 	for {
-		var msg string
-		if err := websocket.Message.Receive(c.ws, &msg); err != nil {
-			log.Println("Error receiving message:", err)
-			// TODO:
-			// * Put the sleeping in the reconnection function itself
-			// * Also do this when there's a send failure
-			// * Don't try to send or receive at all when we're disconnected
-			for {
-				err := c.reconnect()
-				if err == nil {
-					log.Println("Reconnection successful.")
-					break
+		ws := c.waitConnected()
+		if ws == nil {
+			return
+		}
+		frame, err := ws.ReadFrame()
+		if err != nil {
+			c.disconnected(ws, err)
+			continue
+		}
+		e, err := protocol.DecodeString(frame)
+		if err != nil {
+			log.Println("Warning: received bad message:", err)
+			continue
+		}
+		c.track(e)
+		select {
+		case c.In <- e:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Conn) send() {
+	for {
+		m, wait := c.queue.next(c.limiter)
+		if m == nil {
+			// Wait for a new message or for the rate limit to allow a waiting one.
+			var retry <-chan time.Time
+			if wait > 0 {
+				retry = time.After(wait)
+			}
+			select {
+			case <-c.queue.pushed:
+			case <-retry:
+			case <-c.done:
+				return
+			}
+			continue
+		}
+		// Leave the message in the queue until it has been written to a live connection.
+		ws := c.waitConnected()
+		if ws == nil {
+			return
+		}
+		// It may have gone stale while we waited.
+		if c.queue.expired(m) {
+			log.Println("Discarding stale message queued at", m.Queued)
+			if m.ack != nil {
+				m.ack.receipt.fail(ErrExpired)
+			}
+			c.pop(m)
+			continue
+		}
+		if err := ws.WriteFrame(m.Frame); err != nil {
+			c.disconnected(ws, err)
+			continue
+		}
+		if m.chat && c.limiter != nil {
+			c.limiter.take(m.Channel, time.Now())
+		}
+		if m.ack != nil {
+			c.wrote(m.ack)
+		}
+		c.pop(m)
+	}
+}
+
+func (c *Conn) pop(m *queuedMessage) {
+	if err := c.queue.pop(m); err != nil {
+		log.Println("Error updating queue file:", err)
+	}
+}
+
+// maintain waits for the connection to be lost and re-establishes it.
+func (c *Conn) maintain() {
+	for {
+		select {
+		case <-c.lost:
+		case <-c.done:
+			return
+		}
+		c.emit(StateDisconnected)
+		for attempt := 0; ; attempt++ {
+			if !c.transition(StateDisconnected, StateConnecting, nil) {
+				return
+			}
+			ws, err := c.transport.Dial()
+			if err == nil {
+				err = c.rejoin(ws)
+			}
+			if err == nil {
+				if !c.transition(StateConnecting, StateConnected, ws) {
+					ws.Close()
+					return
 				}
-				log.Println("Reconnection failed:", err)
-				time.Sleep(ReconnectFrequency)
+				log.Println("Reconnection successful.")
+				c.emit(StateConnected)
+				break
+			}
+			if ws != nil {
+				ws.Close()
+			}
+			if !c.transition(StateConnecting, StateDisconnected, nil) {
+				return
+			}
+			delay := backoff(attempt, c.minDelay, c.maxDelay)
+			log.Printf("Reconnection failed: %s (retrying in %s)", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-c.done:
+				return
 			}
 		}
-		c.In <- msg
 	}
 }
 
-func (c *Conn) ping() {
-	ping := &Message{
-		Action: "ping",
-		Data:   map[string]string{"message": "PING"},
+// backoff returns how long to wait after the given (zero-indexed) failed reconnection attempt, backing off
+// from min to max.
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
 	}
-	j, err := json.Marshal(ping)
-	if err != nil {
-		log.Fatal(err)
+	if d > max {
+		d = max
 	}
-	// Send a heartbeat ping every N seconds.
-	ticker := time.NewTicker(PingFrequency)
-	for _ = range ticker.C {
-		c.out <- string(j)
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// Options holds optional connection settings. The zero value is valid.
+type Options struct {
+	// Name identifies the connection when a process has several (see Set).
+	Name string
+	// Username is who we're connecting as. The server tells every member of a channel about joins, leaves
+	// and messages, and only the ones from us change the channels we rejoin after reconnecting or
+	// acknowledge Receipts. If Username is empty, only Join and Leave change the channels, and Receipts are
+	// never acknowledged.
+	Username string
+
+	// If QueueFile is set, outgoing chat messages are saved there until they are sent, and any messages
+	// left unsent by a previous process are sent after connecting.
+	QueueFile string
+	// Queued messages older than QueueMaxAge are discarded instead of sent. Zero means no limit.
+	QueueMaxAge time.Duration
+
+	// Chat messages are rate limited per channel and overall by token buckets that hold up to
+	// ChannelBurst/GlobalBurst messages and refill at ChannelRate/GlobalRate messages per second. A zero
+	// rate means no limit.
+	ChannelRate  float64
+	ChannelBurst int
+	GlobalRate   float64
+	GlobalBurst  int
+	// If CoalesceWindow is set, messages sent to a channel within that long of the first are joined with
+	// newlines and sent as a single message.
+	CoalesceWindow time.Duration
+	// Messages longer than MaxMessageLength bytes are split into several. Zero means no limit.
+	MaxMessageLength int
+
+	// TLS settings for wss:// addresses (used by Connect)
+	TLS *TLSOptions
+	// Dialer makes the underlying network connection for Connect (see ProxyDialer). Nil means dial
+	// directly.
+	Dialer proxy.Dialer
+}
+
+type Conn struct {
+	// Name is the Options.Name the connection was created with.
+	Name string
+	// Messages come out here
+	In chan protocol.Event
+	// State changes come out here: StateDisconnected when the connection is lost, StateConnected when it
+	// has been re-established, and StateClosed after Close.
+	States    chan State
+	queue     *queue
+	transport Transport
+	opts      *Options
+
+	limiter   *limiter
+	coalescer *coalescer
+
+	mu    sync.Mutex
+	cond  *sync.Cond // Signaled on every state change
+	state State
+	ws    Socket
+	lost  chan struct{}
+	done  chan struct{}
+	// The channels we've joined, which are rejoined after reconnecting
+	channels map[string]bool
+	// The set this connection belongs to, if any
+	set *Set
+	// Written messages waiting to be echoed by the server, oldest first
+	acks []*pendingAck
+	// Pings sent on the current socket that haven't been answered yet, by message
+	pings     map[string]time.Time
+	heartbeat Heartbeat
+
+	// PingFrequency and so on, as they were when we connected
+	pingFrequency      time.Duration
+	maxMissedPongs     int
+	minDelay, maxDelay time.Duration
+}
+
+// State returns the current state of the connection.
+func (c *Conn) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// transition moves the connection from one state to another, returning false if it wasn't in the expected
+// state (that is, if it has been closed in the meantime). If ws is non-nil it becomes the live socket.
+func (c *Conn) transition(from, to State, ws Socket) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != from {
+		return false
+	}
+	c.state = to
+	if ws != nil {
+		c.ws = ws
+		c.pings = make(map[string]time.Time)
 	}
+	c.cond.Broadcast()
+	return true
 }
 
-func (c *Conn) send() {
-	for msg := range c.out {
-		if err := websocket.Message.Send(c.ws, msg); err != nil {
-			log.Println("Error sending message:", err)
+// waitConnected blocks until the connection is up and returns the live socket, or nil if the connection
+// has been closed.
+func (c *Conn) waitConnected() Socket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.state != StateConnected && c.state != StateClosed {
+		c.cond.Wait()
+	}
+	if c.state == StateClosed {
+		return nil
+	}
+	return c.ws
+}
+
+// disconnected is called when reading from or writing to ws fails. The first failure on a live socket
+// marks the connection as disconnected and kicks off reconnection; later failures on the same socket
+// are ignored.
+func (c *Conn) disconnected(ws Socket, err error) {
+	c.mu.Lock()
+	if c.state != StateConnected || c.ws != ws {
+		c.mu.Unlock()
+		return
+	}
+	log.Println("Connection lost:", err)
+	c.ws = nil
+	c.state = StateDisconnected
+	c.cond.Broadcast()
+	select {
+	case c.lost <- struct{}{}:
+	default:
+	}
+	c.mu.Unlock()
+	// Closing may have to wait for a write that's stuck on the dead socket, which mustn't hold up anything
+	// else.
+	ws.Close()
+}
+
+// track updates the joined channel set from the server's join_channel and leave_channel messages about us
+// and the heartbeat from its pongs, and acknowledges our messages when the server echoes them.
+func (c *Conn) track(e protocol.Event) {
+	switch e := e.(type) {
+	case *protocol.JoinChannel:
+		if e.Channel != "" && c.isUs(e.User) {
+			c.setJoined(e.Channel, true)
+			c.acked(e.Action(), e.Channel, "")
+		}
+	case *protocol.LeaveChannel:
+		if e.Channel != "" && c.isUs(e.User) {
+			c.setJoined(e.Channel, false)
+			c.acked(e.Action(), e.Channel, "")
+		}
+	case *protocol.PublishMessage:
+		if c.isUs(e.User) {
+			c.acked(e.Action(), e.Channel, e.Message)
 		}
+	case *protocol.Pong:
+		c.ponged(e.Message, time.Now())
 	}
 }
 
-type credentials struct {
-	addrString, apiKey, secret string
+// isUs reports whether u is the user we're connected as (see Options.Username).
+func (c *Conn) isUs(u *protocol.User) bool {
+	return c.opts.Username != "" && u != nil && u.Username == c.opts.Username
 }
 
-type Conn struct {
-	ws *websocket.Conn
-	// Messages come out here
-	In    chan string
-	out   chan string
-	creds *credentials
+func (c *Conn) setJoined(channel string, joined bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if joined {
+		c.channels[channel] = true
+	} else {
+		delete(c.channels, channel)
+	}
+}
+
+// Channels returns the (sorted) channels the connection is currently in.
+func (c *Conn) Channels() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var channels []string
+	for channel := range c.channels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// InChannel reports whether the connection is currently in channel.
+func (c *Conn) InChannel(channel string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.channels[channel]
+}
+
+// rejoin joins all of our channels on a freshly dialed socket, before anything else is sent on it.
+func (c *Conn) rejoin(ws Socket) error {
+	for _, channel := range c.Channels() {
+		frame, err := protocol.EncodeString(&protocol.JoinChannel{Channel: channel})
+		if err != nil {
+			return err
+		}
+		if err := ws.WriteFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-type Message struct {
-	Action string            `json:"action"`
-	Data   map[string]string `json:"data"`
+func (c *Conn) emit(s State) {
+	select {
+	case c.States <- s:
+	case <-c.done:
+	}
 }
 
-func (c *Conn) sendJsonData(d interface{}) error {
-	j, err := json.Marshal(d)
+// sendEvent queues a message to be sent as soon as the connection is up, reporting its progress to r if
+// it's non-nil. Only chat messages are persisted; joins and leaves are tracked separately and replayed by
+// rejoin.
+func (c *Conn) sendEvent(e protocol.Event, r *Receipt) error {
+	frame, err := protocol.EncodeString(e)
 	if err != nil {
 		return err
 	}
-	c.out <- string(j)
-	return nil
+	var channel, message string
+	switch e := e.(type) {
+	case *protocol.PublishMessage:
+		channel, message = e.Channel, e.Message
+	case *protocol.JoinChannel:
+		channel = e.Channel
+	case *protocol.LeaveChannel:
+		channel = e.Channel
+	}
+	var ack *pendingAck
+	if r != nil {
+		ack = &pendingAck{
+			action:  e.Action(),
+			channel: channel,
+			message: message,
+			receipt: r,
+		}
+	}
+	_, chat := e.(*protocol.PublishMessage)
+	return c.queue.push(frame, channel, chat, ack)
+}
+
+// Pending returns the number of queued messages that haven't been sent yet.
+func (c *Conn) Pending() int {
+	return c.queue.len()
+}
+
+// Flush waits up to timeout for all queued messages to be sent and returns the number left unsent.
+func (c *Conn) Flush(timeout time.Duration) int {
+	if c.coalescer != nil {
+		c.coalescer.flushAll()
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		n := c.queue.len()
+		if n == 0 || c.State() == StateClosed || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
 }
 
 func (c *Conn) SendMessage(channel, msg string) error {
-	data := map[string]string{"channel": channel, "message": msg}
-	m := &Message{
-		Action: "publish_message",
-		Data:   data,
+	if c.coalescer != nil {
+		if c.State() == StateClosed {
+			return ErrClosed
+		}
+		c.coalescer.add(channel, msg)
+		return nil
+	}
+	return c.publish(channel, msg)
+}
+
+// SendMessageAck is like SendMessage, but returns a Receipt for tracking delivery (which needs
+// Options.Username). Messages sent this way are never coalesced with others, but any waiting to be
+// coalesced for the channel are sent first, so they still arrive in order.
+func (c *Conn) SendMessageAck(channel, msg string) (*Receipt, error) {
+	chunks := splitMessage(msg, c.opts.MaxMessageLength)
+	r := newReceipt(len(chunks))
+	send := func() error { return c.publishChunks(channel, chunks, r) }
+	var err error
+	if c.coalescer != nil {
+		err = c.coalescer.before(channel, send)
+	} else {
+		err = send()
 	}
-	return c.sendJsonData(m)
+	if err != nil {
+		r.fail(err)
+		return nil, err
+	}
+	return r, nil
+}
+
+// publish queues msg for channel, split into several messages if it's too long.
+func (c *Conn) publish(channel, msg string) error {
+	return c.publishChunks(channel, splitMessage(msg, c.opts.MaxMessageLength), nil)
+}
+
+func (c *Conn) publishChunks(channel string, chunks []string, r *Receipt) error {
+	for _, chunk := range chunks {
+		m := &protocol.PublishMessage{Channel: channel, Message: chunk}
+		if err := c.sendEvent(m, r); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (c *Conn) Join(channel string) error {
-	data := map[string]string{"channel": channel}
-	m := &Message{
-		Action: "join_channel",
-		Data:   data,
+	_, err := c.join(channel, nil)
+	return err
+}
+
+// JoinAck is like Join, but returns a Receipt for tracking when the server has put us in the channel.
+func (c *Conn) JoinAck(channel string) (*Receipt, error) {
+	return c.join(channel, newReceipt(1))
+}
+
+func (c *Conn) join(channel string, r *Receipt) (*Receipt, error) {
+	if err := c.sendEvent(&protocol.JoinChannel{Channel: channel}, r); err != nil {
+		return nil, err
 	}
-	return c.sendJsonData(m)
+	c.setJoined(channel, true)
+	return r, nil
 }
 
 func (c *Conn) Leave(channel string) error {
-	data := map[string]string{"channel": channel}
-	m := &Message{
-		Action: "leave_channel",
-		Data:   data,
+	_, err := c.leave(channel, nil)
+	return err
+}
+
+// LeaveAck is like Leave, but returns a Receipt for tracking when the server has taken us out of the
+// channel.
+func (c *Conn) LeaveAck(channel string) (*Receipt, error) {
+	return c.leave(channel, newReceipt(1))
+}
+
+func (c *Conn) leave(channel string, r *Receipt) (*Receipt, error) {
+	if err := c.sendEvent(&protocol.LeaveChannel{Channel: channel}, r); err != nil {
+		return nil, err
 	}
-	return c.sendJsonData(m)
+	c.setJoined(channel, false)
+	return r, nil
 }
 
-func (c *Conn) connect() error {
-	connectionString := c.creds.addrString + authutil.SignRequest("/eventhub", c.creds.apiKey, c.creds.secret)
-	config, err := websocket.NewConfig(connectionString, "http://localhost")
-	if err != nil {
-		return err
+// Close shuts down the connection and stops all of its goroutines. Sends on a closed connection fail with
+// ErrClosed.
+func (c *Conn) Close() error {
+	if c.coalescer != nil {
+		c.coalescer.flushAll()
 	}
-	// Ignore certs for now
-	config.TlsConfig = &tls.Config{InsecureSkipVerify: true}
-	ws, err := websocket.DialConfig(config)
-	if err != nil {
-		return err
+	c.mu.Lock()
+	if c.state == StateClosed {
+		c.mu.Unlock()
+		return nil
 	}
-	c.ws = ws
-	return nil
+	c.state = StateClosed
+	ws := c.ws
+	c.ws = nil
+	c.cond.Broadcast()
+	close(c.done)
+	c.mu.Unlock()
+	if err := c.queue.close(); err != nil {
+		log.Println("Error closing queue file:", err)
+	}
+	c.failAcks(ErrClosed)
+
+	select {
+	case c.States <- StateClosed:
+	default:
+	}
+	if ws == nil {
+		return nil
+	}
+	return ws.Close()
 }
 
-func (c *Conn) reconnect() error {
-	if err := c.connect(); err != nil {
-		return err
+// Connect dials the Prat server at addrString over a websocket and starts the connection's goroutines.
+// opts may be nil.
+func Connect(addrString, apiKey, secret string, opts *Options) (*Conn, error) {
+	return ConnectCredentials(addrString, authutil.Static{APIKey: apiKey, Secret: secret}, opts)
+}
+
+// ConnectCredentials is like Connect, but gets the credentials from creds each time it (re)connects.
+func ConnectCredentials(addrString string, creds authutil.Source, opts *Options) (*Conn, error) {
+	t, err := NewWebsocketTransport(addrString, creds, opts)
+	if err != nil {
+		return nil, err
 	}
-	// TODO: shouldn't have a hard-coded channel for this, but instead a configurable status channel.
-	c.SendMessage("pratbot", "Pratbot reconnected.")
-	return nil
+	return ConnectTransport(t, opts)
 }
 
-func Connect(addrString, apiKey, secret string) (*Conn, error) {
-	conn := &Conn{creds: &credentials{addrString, apiKey, secret}}
-	if err := conn.connect(); err != nil {
+// ConnectTransport is like Connect, but connects using t. The TLS and Dialer options are ignored.
+func ConnectTransport(t Transport, opts *Options) (*Conn, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	q, err := newQueue(opts.QueueFile, opts.QueueMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	conn := &Conn{
+		Name:      opts.Name,
+		queue:     q,
+		transport: t,
+		opts:      opts,
+		limiter:   newLimiter(opts),
+		state:     StateConnecting,
+		lost:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+
+		channels: make(map[string]bool),
+
+		pingFrequency:  PingFrequency,
+		maxMissedPongs: MaxMissedPongs,
+		minDelay:       ReconnectMinDelay,
+		maxDelay:       ReconnectMaxDelay,
+	}
+	conn.cond = sync.NewCond(&conn.mu)
+	if opts.CoalesceWindow > 0 {
+		conn.coalescer = newCoalescer(opts.CoalesceWindow, conn.publish)
+	}
+	ws, err := conn.transport.Dial()
+	if err != nil {
+		q.close()
 		return nil, err
 	}
-	conn.In = make(chan string)
-	conn.out = make(chan string)
+	conn.transition(StateConnecting, StateConnected, ws)
+	conn.In = make(chan protocol.Event)
+	// Buffered so that state changes don't wait on a busy receiver.
+	conn.States = make(chan State, 8)
 
 	// Start goroutines
 	go conn.receive()
 	go conn.ping()
 	go conn.send()
+	go conn.maintain()
 
 	return conn, nil
 }
@@ -0,0 +1,508 @@
+package connection
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"protocol"
+)
+
+const testTimeout = 5 * time.Second
+
+// A testServer is the far end of a Conn made with a PipeTransport.
+type testServer struct {
+	t         *testing.T
+	transport *PipeTransport
+	socket    *PipeSocket
+	// Frames the connection has written to the current socket
+	frames chan protocol.Event
+}
+
+// connectPipe connects over a PipeTransport and returns the connection and the server end. Everything
+// the connection receives can be read from its In channel as usual.
+func connectPipe(t *testing.T, opts *Options) (*Conn, *testServer) {
+	s := &testServer{t: t, transport: NewPipeTransport()}
+	conn, err := ConnectTransport(s.transport, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.accept()
+	return conn, s
+}
+
+// accept takes the server end of the next dial and starts reading from it.
+func (s *testServer) accept() {
+	select {
+	case s.socket = <-s.transport.accept:
+	case <-time.After(testTimeout):
+		s.t.Fatal("timed out waiting for the connection to dial")
+	}
+	frames := make(chan protocol.Event, 100)
+	s.frames = frames
+	go func(ps *PipeSocket) {
+		defer close(frames)
+		for {
+			frame, err := ps.ReadFrame()
+			if err != nil {
+				return
+			}
+			e, err := protocol.DecodeString(frame)
+			if err != nil {
+				panic(err)
+			}
+			frames <- e
+		}
+	}(s.socket)
+}
+
+// send sends e to the connection.
+func (s *testServer) send(e protocol.Event) {
+	frame, err := protocol.EncodeString(e)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if err := s.socket.WriteFrame(frame); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// next returns the next frame the connection wrote, other than pings.
+func (s *testServer) next() protocol.Event {
+	for {
+		select {
+		case e, ok := <-s.frames:
+			if !ok {
+				s.t.Fatal("socket closed")
+			}
+			if _, ok := e.(*protocol.Ping); ok {
+				continue
+			}
+			return e
+		case <-time.After(testTimeout):
+			s.t.Fatal("timed out waiting for a frame")
+		}
+	}
+}
+
+// expect checks that the next frame the connection wrote is want.
+func (s *testServer) expect(want protocol.Event) {
+	if got := s.next(); !reflect.DeepEqual(got, want) {
+		s.t.Fatalf("got %#v; want %#v", got, want)
+	}
+}
+
+// receive returns the next event from the connection's In channel.
+func receive(t *testing.T, conn *Conn) protocol.Event {
+	select {
+	case e := <-conn.In:
+		return e
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for an event")
+	}
+	return nil
+}
+
+// expectState checks that the next state change the connection reports is want.
+func expectState(t *testing.T, conn *Conn, want State) {
+	select {
+	case s := <-conn.States:
+		if s != want {
+			t.Fatalf("got state %s; want %s", s, want)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for state %s", want)
+	}
+}
+
+// fastTimers shortens the reconnection delays and ping interval for the rest of the test.
+func fastTimers(t *testing.T) {
+	minDelay, maxDelay, frequency, missed := ReconnectMinDelay, ReconnectMaxDelay, PingFrequency, MaxMissedPongs
+	ReconnectMinDelay, ReconnectMaxDelay = 5*time.Millisecond, 20*time.Millisecond
+	PingFrequency = 10 * time.Millisecond
+	MaxMissedPongs = 3
+	t.Cleanup(func() {
+		ReconnectMinDelay, ReconnectMaxDelay, PingFrequency, MaxMissedPongs = minDelay, maxDelay, frequency, missed
+	})
+}
+
+var (
+	us    = &protocol.User{Username: "pratbot"}
+	alice = &protocol.User{Username: "alice"}
+)
+
+func TestChannelsOnlyTrackOurNotices(t *testing.T) {
+	conn, s := connectPipe(t, &Options{Username: us.Username})
+	defer conn.Close()
+
+	conn.Join("general")
+	s.expect(&protocol.JoinChannel{Channel: "general"})
+	for _, e := range []protocol.Event{
+		&protocol.JoinChannel{User: us, Channel: "general"},
+		// Other members coming and going doesn't affect us.
+		&protocol.LeaveChannel{User: alice, Channel: "general"},
+		&protocol.JoinChannel{User: alice, Channel: "random"},
+		// The server putting us in a channel does.
+		&protocol.JoinChannel{User: us, Channel: "bot-test"},
+	} {
+		s.send(e)
+		receive(t, conn)
+	}
+	if got, want := conn.Channels(), []string{"bot-test", "general"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Channels() = %v; want %v", got, want)
+	}
+
+	s.send(&protocol.LeaveChannel{User: us, Channel: "bot-test"})
+	receive(t, conn)
+	if got, want := conn.Channels(), []string{"general"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Channels() = %v; want %v", got, want)
+	}
+
+	// We rejoin general, and only general, after reconnecting.
+	s.socket.Close()
+	s.accept()
+	s.expect(&protocol.JoinChannel{Channel: "general"})
+}
+
+func TestChannelsWithoutUsername(t *testing.T) {
+	conn, s := connectPipe(t, nil)
+	defer conn.Close()
+
+	conn.Join("general")
+	s.expect(&protocol.JoinChannel{Channel: "general"})
+	s.send(&protocol.LeaveChannel{User: alice, Channel: "general"})
+	receive(t, conn)
+	s.send(&protocol.JoinChannel{User: alice, Channel: "random"})
+	receive(t, conn)
+	if got, want := conn.Channels(), []string{"general"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Channels() = %v; want %v", got, want)
+	}
+	conn.Leave("general")
+	if got := conn.Channels(); len(got) != 0 {
+		t.Fatalf("Channels() = %v after leaving", got)
+	}
+}
+
+func TestReceiptsOnlyAckOurEchoes(t *testing.T) {
+	conn, s := connectPipe(t, &Options{Username: us.Username})
+	defer conn.Close()
+
+	r, err := conn.SendMessageAck("general", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.expect(&protocol.PublishMessage{Channel: "general", Message: "hello"})
+	if err := r.WaitWritten(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	j, err := conn.JoinAck("random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.expect(&protocol.JoinChannel{Channel: "random"})
+	if err := j.WaitWritten(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same message or join from someone else isn't ours.
+	s.send(&protocol.PublishMessage{User: alice, Channel: "general", Message: "hello"})
+	receive(t, conn)
+	s.send(&protocol.JoinChannel{User: alice, Channel: "random"})
+	receive(t, conn)
+	if err := r.Wait(10 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("message acknowledged by someone else's echo (err = %v)", err)
+	}
+	if err := j.Wait(10 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("join acknowledged by someone else's (err = %v)", err)
+	}
+
+	s.send(&protocol.PublishMessage{User: us, Channel: "general", Message: "hello"})
+	receive(t, conn)
+	s.send(&protocol.JoinChannel{User: us, Channel: "random"})
+	receive(t, conn)
+	if err := r.Wait(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Wait(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	min, max := time.Second, 10*time.Second
+	for attempt, nominal := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, max, max} {
+		for i := 0; i < 100; i++ {
+			if d := backoff(attempt, min, max); d < nominal/2 || d > nominal {
+				t.Fatalf("backoff(%d) = %s; want %s-%s", attempt, d, nominal/2, nominal)
+			}
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	fastTimers(t)
+	conn, s := connectPipe(t, &Options{Username: us.Username})
+	defer conn.Close()
+	conn.Join("general")
+	s.expect(&protocol.JoinChannel{Channel: "general"})
+	conn.Join("random")
+	s.expect(&protocol.JoinChannel{Channel: "random"})
+
+	// Lose the connection, and fail to get it back for a while.
+	s.transport.FailDials(errors.New("no route to host"))
+	s.socket.Close()
+	expectState(t, conn, StateDisconnected)
+	if err := conn.SendMessage("general", "sent while disconnected"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := conn.State(); got == StateConnected {
+		t.Fatal("connected while dials fail")
+	}
+	if got := conn.Pending(); got != 1 {
+		t.Fatalf("Pending() = %d; want 1", got)
+	}
+
+	// Once we're back, we rejoin our channels before anything else, then send what was queued.
+	s.transport.FailDials(nil)
+	s.accept()
+	expectState(t, conn, StateConnected)
+	s.expect(&protocol.JoinChannel{Channel: "general"})
+	s.expect(&protocol.JoinChannel{Channel: "random"})
+	s.expect(&protocol.PublishMessage{Channel: "general", Message: "sent while disconnected"})
+
+	// Messages flow both ways on the new socket.
+	s.send(&protocol.PublishMessage{User: alice, Channel: "general", Message: "welcome back"})
+	if e, ok := receive(t, conn).(*protocol.PublishMessage); !ok || e.Message != "welcome back" {
+		t.Fatalf("got %#v", e)
+	}
+	conn.SendMessage("general", "thanks")
+	s.expect(&protocol.PublishMessage{Channel: "general", Message: "thanks"})
+}
+
+func TestQueueReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "connection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := &Options{QueueFile: filepath.Join(dir, "queue")}
+
+	conn, s := connectPipe(t, opts)
+	conn.SendMessage("general", "one")
+	s.expect(&protocol.PublishMessage{Channel: "general", Message: "one"})
+	if n := conn.Flush(testTimeout); n != 0 {
+		t.Fatalf("%d messages unsent", n)
+	}
+	// Messages queued while we can't reach the server survive a restart...
+	s.transport.FailDials(errors.New("no route to host"))
+	s.socket.Close()
+	expectState(t, conn, StateDisconnected)
+	conn.SendMessage("general", "two")
+	conn.SendMessage("random", "three")
+	// ...but joins aren't queued (they're replayed from the channel list instead).
+	conn.Join("general")
+	conn.Close()
+
+	conn, s = connectPipe(t, opts)
+	defer conn.Close()
+	s.expect(&protocol.PublishMessage{Channel: "general", Message: "two"})
+	s.expect(&protocol.PublishMessage{Channel: "random", Message: "three"})
+	if n := conn.Flush(testTimeout); n != 0 {
+		t.Fatalf("%d messages unsent", n)
+	}
+	conn.Close()
+
+	// Once sent, they aren't sent again.
+	conn, s = connectPipe(t, opts)
+	defer conn.Close()
+	conn.SendMessage("general", "four")
+	s.expect(&protocol.PublishMessage{Channel: "general", Message: "four"})
+}
+
+func TestQueueMaxAge(t *testing.T) {
+	fastTimers(t)
+	conn, s := connectPipe(t, &Options{QueueMaxAge: 50 * time.Millisecond})
+	defer conn.Close()
+	s.transport.FailDials(errors.New("no route to host"))
+	s.socket.Close()
+	expectState(t, conn, StateDisconnected)
+	r, err := conn.SendMessageAck("general", "stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The message expires while we wait to reconnect, and isn't sent afterwards.
+	time.Sleep(100 * time.Millisecond)
+	s.transport.FailDials(nil)
+	s.accept()
+	if err := r.WaitWritten(testTimeout); err != ErrExpired {
+		t.Fatalf("WaitWritten: got %v; want %v", err, ErrExpired)
+	}
+	conn.SendMessage("general", "fresh")
+	s.expect(&protocol.PublishMessage{Channel: "general", Message: "fresh"})
+}
+
+func TestMissedPongs(t *testing.T) {
+	fastTimers(t)
+	conn, s := connectPipe(t, nil)
+	defer conn.Close()
+
+	// Answer a ping, and the heartbeat notices.
+	var ping *protocol.Ping
+	for ping == nil {
+		select {
+		case e := <-s.frames:
+			ping, _ = e.(*protocol.Ping)
+		case <-time.After(testTimeout):
+			t.Fatal("no ping")
+		}
+	}
+	s.send(&protocol.Pong{Message: ping.Message})
+	receive(t, conn)
+	if h := conn.Heartbeat(); h.LastPong.IsZero() {
+		t.Errorf("Heartbeat() = %+v after a pong", h)
+	}
+
+	// Ignore the rest, and the connection is dropped and re-established.
+	expectState(t, conn, StateDisconnected)
+	s.accept()
+	expectState(t, conn, StateConnected)
+	if h := conn.Heartbeat(); h.Outstanding > MaxMissedPongs {
+		t.Errorf("Heartbeat() = %+v on a new socket", h)
+	}
+}
+
+func TestReceiptsFailOnClose(t *testing.T) {
+	conn, s := connectPipe(t, &Options{Username: us.Username})
+	sent, err := conn.SendMessageAck("general", "sent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.expect(&protocol.PublishMessage{Channel: "general", Message: "sent"})
+	if err := sent.WaitWritten(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	s.transport.FailDials(errors.New("no route to host"))
+	s.socket.Close()
+	expectState(t, conn, StateDisconnected)
+	unsent, err := conn.SendMessageAck("general", "unsent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+	if err := sent.Wait(testTimeout); err != ErrClosed {
+		t.Errorf("Wait for a written message: got %v; want %v", err, ErrClosed)
+	}
+	if err := unsent.WaitWritten(testTimeout); err != ErrClosed {
+		t.Errorf("WaitWritten for an unsent message: got %v; want %v", err, ErrClosed)
+	}
+	if _, err := conn.SendMessageAck("general", "after close"); err != ErrClosed {
+		t.Errorf("SendMessageAck after Close: got %v; want %v", err, ErrClosed)
+	}
+}
+
+// A message split into parts is only acknowledged once every part is.
+func TestReceiptParts(t *testing.T) {
+	conn, s := connectPipe(t, &Options{Username: us.Username, MaxMessageLength: 5})
+	defer conn.Close()
+	r, err := conn.SendMessageAck("general", "hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []string
+	for len(parts) < 3 {
+		m, ok := s.next().(*protocol.PublishMessage)
+		if !ok {
+			t.Fatalf("got %#v", m)
+		}
+		parts = append(parts, m.Message)
+	}
+	if err := r.WaitWritten(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	for i, part := range parts {
+		if err := r.Wait(time.Millisecond); err != ErrTimeout {
+			t.Fatalf("acknowledged after %d of %d parts (err = %v)", i, len(parts), err)
+		}
+		s.send(&protocol.PublishMessage{User: us, Channel: "general", Message: part})
+		receive(t, conn)
+	}
+	if err := r.Wait(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A wedgedSocket is a half-open socket: writes hang, and so does closing, until release is closed. Reads
+// fail once fail is closed.
+type wedgedSocket struct {
+	fail, release chan struct{}
+	writing       chan struct{}
+}
+
+func (s *wedgedSocket) ReadFrame() (string, error) {
+	<-s.fail
+	return "", errors.New("read failed")
+}
+
+func (s *wedgedSocket) WriteFrame(frame string) error {
+	s.writing <- struct{}{}
+	<-s.release
+	return errors.New("write failed")
+}
+
+func (s *wedgedSocket) Close() error {
+	<-s.release
+	return nil
+}
+
+// wedgedTransport dials a wedgedSocket once, then fails.
+type wedgedTransport struct {
+	socket *wedgedSocket
+	dialed bool
+}
+
+func (t *wedgedTransport) Dial() (Socket, error) {
+	if t.dialed {
+		return nil, errors.New("dial failed")
+	}
+	t.dialed = true
+	return t.socket, nil
+}
+
+// Losing a socket that's stuck mid-write mustn't hold up the rest of the connection while it closes.
+func TestDisconnectWedgedSocket(t *testing.T) {
+	ws := &wedgedSocket{make(chan struct{}), make(chan struct{}), make(chan struct{}, 1)}
+	conn, err := ConnectTransport(&wedgedTransport{socket: ws}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	defer close(ws.release)
+
+	conn.Join("general")
+	select {
+	case <-ws.writing:
+	case <-time.After(testTimeout):
+		t.Fatal("the join wasn't written")
+	}
+	close(ws.fail)
+	expectState(t, conn, StateDisconnected)
+
+	done := make(chan struct{})
+	go func() {
+		conn.State()
+		conn.Channels()
+		conn.Join("random")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("the connection is stuck behind closing the socket")
+	}
+}
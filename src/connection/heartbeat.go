@@ -0,0 +1,104 @@
+package connection
+
+import (
+	"fmt"
+	"time"
+
+	"protocol"
+)
+
+// Heartbeat describes the responsiveness of the server to our pings.
+type Heartbeat struct {
+	// Round-trip time of the most recently answered ping
+	Latency time.Duration
+	// When the last pong arrived (zero if none has)
+	LastPong time.Time
+	// The number of pings currently awaiting a pong
+	Outstanding int
+}
+
+// Heartbeat returns the current heartbeat status.
+func (c *Conn) Heartbeat() Heartbeat {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.heartbeat
+	h.Outstanding = len(c.pings)
+	return h
+}
+
+// ping sends a heartbeat ping every PingFrequency and drops the connection if MaxMissedPongs of them in a
+// row go unanswered. Pings are written directly rather than queued so that a backlog of outgoing messages
+// doesn't look like a dead connection.
+func (c *Conn) ping() {
+	ticker := time.NewTicker(c.pingFrequency)
+	defer ticker.Stop()
+	for seq := 1; ; seq++ {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+		ws, missed := c.pingState()
+		// Don't ping while we're disconnected.
+		if ws == nil {
+			continue
+		}
+		if missed >= c.maxMissedPongs {
+			c.disconnected(ws, fmt.Errorf("%d pings went unanswered", missed))
+			continue
+		}
+		// Pong messages echo the ping's, which lets us match them up.
+		message := fmt.Sprintf("PING %d", seq)
+		frame, err := protocol.EncodeString(&protocol.Ping{Message: message})
+		if err != nil {
+			panic(err)
+		}
+		c.pinged(ws, message, time.Now())
+		if err := ws.WriteFrame(frame); err != nil {
+			c.disconnected(ws, err)
+		}
+	}
+}
+
+// pingState returns the live socket (nil if not connected) and the number of unanswered pings on it.
+func (c *Conn) pingState() (Socket, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != StateConnected {
+		return nil, 0
+	}
+	return c.ws, len(c.pings)
+}
+
+func (c *Conn) pinged(ws Socket, message string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ws == ws {
+		c.pings[message] = t
+	}
+}
+
+// ponged records the arrival of a pong. If its message doesn't match any ping we sent, it's assumed to
+// answer the oldest one. Any pings older than the answered one are forgotten as well.
+func (c *Conn) ponged(message string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sent, ok := c.pings[message]
+	if !ok {
+		for _, s := range c.pings {
+			if !ok || s.Before(sent) {
+				sent, ok = s, true
+			}
+		}
+		if !ok {
+			return
+		}
+	}
+	for m, s := range c.pings {
+		if !s.After(sent) {
+			delete(c.pings, m)
+		}
+	}
+	c.heartbeat.Latency = t.Sub(sent)
+	c.heartbeat.LastPong = t
+}
@@ -0,0 +1,173 @@
+package connection
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"ratelimit"
+)
+
+// limiter rate limits chat messages, both per channel and overall.
+type limiter struct {
+	mu           sync.Mutex
+	global       *ratelimit.Bucket
+	channels     map[string]*ratelimit.Bucket
+	channelRate  float64
+	channelBurst int
+}
+
+// newLimiter returns a limiter according to opts, or nil if opts don't call for any limits.
+func newLimiter(opts *Options) *limiter {
+	if opts.GlobalRate <= 0 && opts.ChannelRate <= 0 {
+		return nil
+	}
+	l := &limiter{
+		channels:     make(map[string]*ratelimit.Bucket),
+		channelRate:  opts.ChannelRate,
+		channelBurst: opts.ChannelBurst,
+	}
+	if opts.GlobalRate > 0 {
+		l.global = ratelimit.NewBucket(opts.GlobalRate, opts.GlobalBurst)
+	}
+	return l
+}
+
+func (l *limiter) bucket(channel string) *ratelimit.Bucket {
+	if l.channelRate <= 0 {
+		return nil
+	}
+	b, ok := l.channels[channel]
+	if !ok {
+		b = ratelimit.NewBucket(l.channelRate, l.channelBurst)
+		l.channels[channel] = b
+	}
+	return b
+}
+
+// delay returns how long until a message may be sent to channel.
+func (l *limiter) delay(channel string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var d time.Duration
+	if l.global != nil {
+		d = l.global.Delay(now)
+	}
+	if b := l.bucket(channel); b != nil {
+		if cd := b.Delay(now); cd > d {
+			d = cd
+		}
+	}
+	return d
+}
+
+// take records that a message was sent to channel.
+func (l *limiter) take(channel string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.global != nil {
+		l.global.Take(now)
+	}
+	if b := l.bucket(channel); b != nil {
+		b.Take(now)
+	}
+}
+
+// A coalescer collects the messages sent to each channel within a window of the first and passes them on
+// joined into one.
+type coalescer struct {
+	mu      sync.Mutex
+	window  time.Duration
+	pending map[string][]string
+	send    func(channel, msg string) error
+}
+
+func newCoalescer(window time.Duration, send func(channel, msg string) error) *coalescer {
+	return &coalescer{
+		window:  window,
+		pending: make(map[string][]string),
+		send:    send,
+	}
+}
+
+func (c *coalescer) add(channel, msg string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	msgs, ok := c.pending[channel]
+	c.pending[channel] = append(msgs, msg)
+	if !ok {
+		time.AfterFunc(c.window, func() { c.flush(channel) })
+	}
+}
+
+func (c *coalescer) flush(channel string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked(channel)
+}
+
+// flushLocked sends the messages pending for channel. c.mu must be held, so that nothing else can be sent
+// to the channel in between.
+func (c *coalescer) flushLocked(channel string) {
+	msgs := c.pending[channel]
+	delete(c.pending, channel)
+	if len(msgs) == 0 {
+		return
+	}
+	if err := c.send(channel, strings.Join(msgs, "\n")); err != nil {
+		log.Println("Error sending coalesced message:", err)
+	}
+}
+
+// before sends the messages pending for channel and then calls send, so that whatever send sends can't
+// overtake messages added earlier.
+func (c *coalescer) before(channel string, send func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked(channel)
+	return send()
+}
+
+func (c *coalescer) flushAll() {
+	c.mu.Lock()
+	var channels []string
+	for channel := range c.pending {
+		channels = append(channels, channel)
+	}
+	c.mu.Unlock()
+	for _, channel := range channels {
+		c.flush(channel)
+	}
+}
+
+// splitMessage splits msg into chunks of at most max bytes, breaking at newlines where possible and never
+// in the middle of a UTF-8 sequence. If max is not positive, msg is not split.
+func splitMessage(msg string, max int) []string {
+	if max <= 0 || len(msg) <= max {
+		return []string{msg}
+	}
+	var chunks []string
+	for len(msg) > max {
+		cut, next := strings.LastIndex(msg[:max+1], "\n"), 0
+		if cut > 0 {
+			next = cut + 1
+		} else {
+			cut = max
+			for cut > 0 && !utf8.RuneStart(msg[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				cut = max
+			}
+			next = cut
+		}
+		chunks = append(chunks, msg[:cut])
+		msg = msg[next:]
+	}
+	if msg != "" {
+		chunks = append(chunks, msg)
+	}
+	return chunks
+}
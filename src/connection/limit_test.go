@@ -0,0 +1,148 @@
+package connection
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"protocol"
+)
+
+func TestLimiter(t *testing.T) {
+	if l := newLimiter(&Options{}); l != nil {
+		t.Error("newLimiter returned a limiter with no limits set")
+	}
+	l := newLimiter(&Options{ChannelRate: 1, ChannelBurst: 2, GlobalRate: 2, GlobalBurst: 3})
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	check := func(channel string, want time.Duration) {
+		t.Helper()
+		if got := l.delay(channel, now); got != want {
+			t.Errorf("delay(%q) = %s; want %s", channel, got, want)
+		}
+	}
+	check("general", 0)
+	l.take("general", now)
+	l.take("general", now)
+	// The channel's burst is used up, but not the global one.
+	check("general", time.Second)
+	check("random", 0)
+	// Now the global one is too.
+	l.take("random", now)
+	check("random", 500*time.Millisecond)
+	check("general", time.Second)
+
+	now = now.Add(500 * time.Millisecond)
+	check("random", 0)
+	check("general", 500*time.Millisecond)
+	now = now.Add(time.Hour)
+	check("general", 0)
+
+	// Only a global limit
+	l = newLimiter(&Options{GlobalRate: 1, GlobalBurst: 1})
+	l.take("general", now)
+	check("random", time.Second)
+	// Only per-channel limits
+	l = newLimiter(&Options{ChannelRate: 1, ChannelBurst: 1})
+	l.take("general", now)
+	check("general", time.Second)
+	check("random", 0)
+}
+
+// sent records the messages passed on by a coalescer.
+type sent struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (s *sent) send(channel, msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs = append(s.msgs, channel+": "+msg)
+	return nil
+}
+
+func (s *sent) get() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.msgs...)
+}
+
+func TestCoalescer(t *testing.T) {
+	var s sent
+	c := newCoalescer(50*time.Millisecond, s.send)
+	c.add("general", "a")
+	c.add("random", "x")
+	c.add("general", "b")
+	if got := s.get(); len(got) != 0 {
+		t.Fatalf("sent %q before the window was up", got)
+	}
+	time.Sleep(200 * time.Millisecond)
+	got := s.get()
+	if len(got) != 2 || !(got[0] == "general: a\nb" && got[1] == "random: x" || got[0] == "random: x" && got[1] == "general: a\nb") {
+		t.Fatalf("sent %q", got)
+	}
+
+	// Anything sent with before goes after what's pending for the channel, but not other channels.
+	s = sent{}
+	c = newCoalescer(time.Hour, s.send)
+	c.add("general", "a")
+	c.add("random", "x")
+	c.before("general", func() error { return s.send("general", "ack") })
+	if got, want := s.get(), []string{"general: a", "general: ack"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q; want %q", got, want)
+	}
+	c.flushAll()
+	if got, want := s.get(), []string{"general: a", "general: ack", "random: x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q after flushAll; want %q", got, want)
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	for _, tt := range []struct {
+		msg  string
+		max  int
+		want []string
+	}{
+		{"hello", 0, []string{"hello"}},
+		{"hello", 5, []string{"hello"}},
+		{"hello world", 5, []string{"hello", " worl", "d"}},
+		// Newlines are preferred, and dropped.
+		{"one\ntwo\nthree", 8, []string{"one\ntwo", "three"}},
+		{"one\ntwo\nthree", 4, []string{"one", "two", "thre", "e"}},
+		{"ab\n\ncd", 3, []string{"ab\n", "cd"}},
+		// Multibyte characters aren't split.
+		{"héllo", 2, []string{"h", "é", "ll", "o"}},
+		{"日本語", 4, []string{"日", "本", "語"}},
+		{"日本語", 3, []string{"日", "本", "語"}},
+	} {
+		if got := splitMessage(tt.msg, tt.max); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitMessage(%q, %d) = %q; want %q", tt.msg, tt.max, got, tt.want)
+		}
+		if tt.max > 0 {
+			for _, chunk := range splitMessage(tt.msg, tt.max) {
+				if len(chunk) > tt.max {
+					t.Errorf("splitMessage(%q, %d) gave a chunk of %d bytes", tt.msg, tt.max, len(chunk))
+				}
+			}
+		}
+	}
+}
+
+// Messages sent with SendMessageAck don't overtake ones waiting to be coalesced.
+func TestCoalescedOrder(t *testing.T) {
+	conn, s := connectPipe(t, &Options{Username: us.Username, CoalesceWindow: time.Hour, MaxMessageLength: 10})
+	defer conn.Close()
+	conn.SendMessage("general", "one")
+	conn.SendMessage("random", "elsewhere")
+	conn.SendMessage("general", "two")
+	if _, err := conn.SendMessageAck("general", strings.Repeat("x", 15)); err != nil {
+		t.Fatal(err)
+	}
+	s.expect(&protocol.PublishMessage{Channel: "general", Message: "one\ntwo"})
+	s.expect(&protocol.PublishMessage{Channel: "general", Message: strings.Repeat("x", 10)})
+	s.expect(&protocol.PublishMessage{Channel: "general", Message: "xxxxx"})
+	conn.Flush(testTimeout)
+	s.expect(&protocol.PublishMessage{Channel: "random", Message: "elsewhere"})
+}
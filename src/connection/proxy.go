@@ -0,0 +1,162 @@
+package connection
+
+import (
+	"bufio"
+	"code.google.com/p/go.net/proxy"
+	"code.google.com/p/go.net/websocket"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+func init() {
+	proxy.RegisterDialerType("http", newHTTPConnect)
+}
+
+// ProxyDialer returns a dialer that connects through the proxy at proxyURL (socks5://[user:pass@]host:port
+// or http://[user:pass@]host:port), except for destinations matched by noProxy (a comma-separated list of
+// hosts, domains, IPs and CIDR ranges, as in NO_PROXY). If proxyURL is empty, the ALL_PROXY and NO_PROXY
+// environment variables are used instead, and if there's no proxy configured at all the dialer connects
+// directly.
+func ProxyDialer(proxyURL, noProxy string) (proxy.Dialer, error) {
+	if proxyURL == "" {
+		proxyURL = getenv("ALL_PROXY")
+		if noProxy == "" {
+			noProxy = getenv("NO_PROXY")
+		}
+	}
+	if proxyURL == "" {
+		return proxy.Direct, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	d, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	if noProxy == "" {
+		return d, nil
+	}
+	perHost := proxy.NewPerHost(d, proxy.Direct)
+	perHost.AddFromString(noProxy)
+	return perHost, nil
+}
+
+// getenv looks up an environment variable in upper case, falling back to lower case.
+func getenv(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// httpConnect is a proxy.Dialer that tunnels through an HTTP proxy using CONNECT.
+type httpConnect struct {
+	addr    string
+	auth    *url.Userinfo
+	forward proxy.Dialer
+}
+
+func newHTTPConnect(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	addr := u.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "80")
+	}
+	return &httpConnect{addr, u.User, forward}, nil
+}
+
+func (h *httpConnect) Dial(network, addr string) (net.Conn, error) {
+	c, err := h.forward.Dial(network, h.addr)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if h.auth != nil {
+		password, _ := h.auth.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(h.auth.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("proxy refused connection to %s: %s", addr, resp.Status)
+	}
+	return &bufferedConn{c, br}, nil
+}
+
+// bufferedConn is a net.Conn that reads through a bufio.Reader, in case the reader has already buffered
+// data from the other side.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// dialWebsocket is like websocket.DialConfig, but makes the underlying connection with d (directly if d
+// is nil), and returns that connection too.
+func dialWebsocket(config *websocket.Config, d proxy.Dialer) (*websocket.Conn, net.Conn, error) {
+	if d == nil {
+		d = proxy.Direct
+	}
+	scheme, host := config.Location.Scheme, config.Location.Host
+	if scheme != "ws" && scheme != "wss" {
+		return nil, nil, websocket.ErrBadScheme
+	}
+	if config.Location.Port() == "" {
+		port := "80"
+		if scheme == "wss" {
+			port = "443"
+		}
+		host = net.JoinHostPort(config.Location.Hostname(), port)
+	}
+	c, err := d.Dial("tcp", host)
+	if err != nil {
+		return nil, nil, err
+	}
+	if scheme == "wss" {
+		tlsConfig := &tls.Config{}
+		if config.TlsConfig != nil {
+			tlsConfig = config.TlsConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(host)
+		}
+		tc := tls.Client(c, tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+		c = tc
+	}
+	ws, err := websocket.NewClient(config, c)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return ws, c, nil
+}
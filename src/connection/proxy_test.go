@@ -0,0 +1,227 @@
+package connection
+
+import (
+	"bufio"
+	"code.google.com/p/go.net/proxy"
+	"code.google.com/p/go.net/websocket"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// connectProxy is an HTTP proxy that answers CONNECT requests with status, tunnelling to the requested
+// address if that's 200, and records the requests.
+type connectProxy struct {
+	ln       net.Listener
+	status   int
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newConnectProxy(t *testing.T, status int) *connectProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := &connectProxy{ln: ln, status: status}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(c)
+		}
+	}()
+	return p
+}
+
+func (p *connectProxy) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.requests = append(p.requests, req)
+	p.mu.Unlock()
+	if p.status != http.StatusOK {
+		fmt.Fprintf(c, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", p.status, http.StatusText(p.status))
+		return
+	}
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		fmt.Fprintf(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer target.Close()
+	io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(target, br)
+	io.Copy(c, target)
+}
+
+func (p *connectProxy) got() []*http.Request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*http.Request(nil), p.requests...)
+}
+
+func (p *connectProxy) url(userinfo string) string {
+	return "http://" + userinfo + p.ln.Addr().String()
+}
+
+// echoThrough opens a websocket to an echo server with d, checks that a frame comes back, and returns the
+// server's host:port.
+func echoThrough(t *testing.T, d proxy.Dialer) (host string, err error) {
+	addr := echoServer(t)
+	config, err := websocket.NewConfig(addr, "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, c, err := dialWebsocket(config, d)
+	if err != nil {
+		return config.Location.Host, err
+	}
+	s := websocketSocket{ws, c}
+	defer s.Close()
+	if err := s.WriteFrame("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := s.ReadFrame(); err != nil || frame != "hello" {
+		t.Fatalf("ReadFrame() = %q, %v", frame, err)
+	}
+	return config.Location.Host, nil
+}
+
+func TestHTTPConnect(t *testing.T) {
+	p := newConnectProxy(t, http.StatusOK)
+	d, err := ProxyDialer(p.url("alice:pass%20word@"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := echoThrough(t, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := p.got()
+	if len(reqs) != 1 {
+		t.Fatalf("proxy got %d requests; want 1", len(reqs))
+	}
+	if r := reqs[0]; r.Method != "CONNECT" || r.Host != host {
+		t.Errorf("proxy got %s %s; want CONNECT %s", r.Method, r.Host, host)
+	}
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:pass word"))
+	if got := reqs[0].Header.Get("Proxy-Authorization"); got != want {
+		t.Errorf("Proxy-Authorization = %q; want %q", got, want)
+	}
+
+	// No credentials, no header.
+	p = newConnectProxy(t, http.StatusOK)
+	if d, err = ProxyDialer(p.url(""), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := echoThrough(t, d); err != nil {
+		t.Fatal(err)
+	}
+	if reqs := p.got(); len(reqs) != 1 {
+		t.Errorf("proxy got %d requests; want 1", len(reqs))
+	} else if auth := reqs[0].Header.Get("Proxy-Authorization"); auth != "" {
+		t.Errorf("Proxy-Authorization = %q with no credentials", auth)
+	}
+}
+
+func TestHTTPConnectRefused(t *testing.T) {
+	p := newConnectProxy(t, http.StatusProxyAuthRequired)
+	d, err := ProxyDialer(p.url(""), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = echoThrough(t, d)
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("got error %v; want the proxy's 407", err)
+	}
+}
+
+func TestHTTPConnectDefaultPort(t *testing.T) {
+	d, err := ProxyDialer("http://proxy.example.org", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, ok := d.(*httpConnect); !ok || h.addr != "proxy.example.org:80" {
+		t.Errorf("got dialer %#v; want one for proxy.example.org:80", d)
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	tests := []struct {
+		noProxy string
+		proxied bool
+	}{
+		{"", true},
+		{"example.com", true},
+		{"127.0.0.1", false},
+		{"example.com,127.0.0.0/8", false},
+	}
+	for _, test := range tests {
+		p := newConnectProxy(t, http.StatusOK)
+		d, err := ProxyDialer(p.url(""), test.noProxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := echoThrough(t, d); err != nil {
+			t.Errorf("NO_PROXY %q: %v", test.noProxy, err)
+			continue
+		}
+		if proxied := len(p.got()) > 0; proxied != test.proxied {
+			t.Errorf("NO_PROXY %q: went through the proxy: %v; want %v", test.noProxy, proxied, test.proxied)
+		}
+	}
+}
+
+func TestProxyEnvironment(t *testing.T) {
+	p := newConnectProxy(t, http.StatusOK)
+	t.Setenv("ALL_PROXY", "")
+	t.Setenv("all_proxy", p.url(""))
+	t.Setenv("NO_PROXY", "127.0.0.1")
+	d, err := ProxyDialer("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := echoThrough(t, d); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.got()) > 0 {
+		t.Error("went through the proxy despite NO_PROXY")
+	}
+
+	// The environment's NO_PROXY doesn't apply to a proxy given explicitly.
+	d, err = ProxyDialer(p.url(""), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := echoThrough(t, d); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.got()) != 1 {
+		t.Error("didn't go through the proxy")
+	}
+
+	// Nothing configured means direct.
+	t.Setenv("all_proxy", "")
+	if d, err = ProxyDialer("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := echoThrough(t, d); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.got()) != 1 {
+		t.Error("went through the proxy with none configured")
+	}
+}
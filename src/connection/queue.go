@@ -0,0 +1,252 @@
+package connection
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A queuedMessage is an outbound frame waiting to be written to the socket. In the queue file, each
+// message is recorded once when it's queued and again (with only ID and Sent set) once it has been sent.
+type queuedMessage struct {
+	ID     int64     `json:"id"`
+	Queued time.Time `json:"queued,omitempty"`
+	// The channel the frame concerns, if any
+	Channel string `json:"channel,omitempty"`
+	Frame   string `json:"frame,omitempty"`
+	Sent    bool   `json:"sent,omitempty"`
+	// Chat messages are persisted and rate limited.
+	chat bool
+	// Set if the sender is waiting on a Receipt
+	ack *pendingAck
+}
+
+// queue buffers outbound messages until they can be sent. Messages are sent in order, except that a
+// rate-limited message may be overtaken by later messages for other channels. If the queue has a file,
+// chat messages are also logged there so that they survive a restart.
+type queue struct {
+	mu sync.Mutex
+	// pushed receives a value whenever a message is pushed.
+	pushed chan struct{}
+	msgs   []*queuedMessage
+	nextID int64
+	maxAge time.Duration
+	f      *os.File
+	closed bool
+}
+
+// newQueue creates a queue. If path is non-empty, unsent messages are loaded from that file and new
+// chat messages are appended to it. Messages older than maxAge (if non-zero) are dropped instead of
+// being sent.
+func newQueue(path string, maxAge time.Duration) (*queue, error) {
+	q := &queue{
+		maxAge: maxAge,
+		pushed: make(chan struct{}, 1),
+	}
+	if path == "" {
+		return q, nil
+	}
+	if err := q.load(path); err != nil {
+		return nil, err
+	}
+	// Rewrite the file with just the unsent messages so it doesn't grow without bound across restarts.
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	q.f = f
+	for _, m := range q.msgs {
+		if err := q.record(m); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	q.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if len(q.msgs) > 0 {
+		log.Printf("Loaded %d unsent messages from %s.", len(q.msgs), path)
+	}
+	return q, nil
+}
+
+func (q *queue) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	var msgs []*queuedMessage
+	sent := make(map[int64]bool)
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial last line means we died in the middle of a write; ignore it.
+			break
+		}
+		if err != nil {
+			return err
+		}
+		m := &queuedMessage{}
+		if err := json.Unmarshal(line, m); err != nil {
+			log.Println("Warning: skipping bad line in queue file:", err)
+			continue
+		}
+		if m.Sent {
+			sent[m.ID] = true
+			continue
+		}
+		m.chat = true
+		msgs = append(msgs, m)
+	}
+	for _, m := range msgs {
+		if !sent[m.ID] {
+			q.msgs = append(q.msgs, m)
+		}
+		if m.ID >= q.nextID {
+			q.nextID = m.ID + 1
+		}
+	}
+	return nil
+}
+
+// record appends m to the queue file. The caller must hold q.mu.
+func (q *queue) record(m *queuedMessage) error {
+	if q.f == nil || !m.chat {
+		return nil
+	}
+	j, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = q.f.Write(append(j, '\n'))
+	return err
+}
+
+// push adds a frame concerning channel (which may be empty) to the end of the queue. Chat messages are
+// logged to the queue file. ack may be nil.
+func (q *queue) push(frame, channel string, chat bool, ack *pendingAck) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	m := &queuedMessage{
+		ID:      q.nextID,
+		Queued:  time.Now(),
+		Channel: channel,
+		Frame:   frame,
+		chat:    chat,
+		ack:     ack,
+	}
+	q.nextID++
+	if err := q.record(m); err != nil {
+		return err
+	}
+	q.msgs = append(q.msgs, m)
+	select {
+	case q.pushed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next returns the first message that may be sent now according to l (which may be nil). A message is
+// never returned ahead of an earlier one for the same channel. If no message may be sent, next returns nil
+// and how long to wait before trying again (zero if the queue is empty).
+func (q *queue) next(l *limiter) (*queuedMessage, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var wait time.Duration
+	held := make(map[string]bool)
+	now := time.Now()
+	for _, m := range q.msgs {
+		if held[m.Channel] {
+			continue
+		}
+		if !m.chat || l == nil {
+			return m, 0
+		}
+		d := l.delay(m.Channel, now)
+		if d == 0 {
+			return m, 0
+		}
+		if wait == 0 || d < wait {
+			wait = d
+		}
+		held[m.Channel] = true
+	}
+	return nil, wait
+}
+
+// expired reports whether m is too old to be worth sending.
+func (q *queue) expired(m *queuedMessage) bool {
+	return q.maxAge > 0 && time.Since(m.Queued) > q.maxAge
+}
+
+// pop removes m from the queue and records that it was sent.
+func (q *queue) pop(m *queuedMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := 0
+	for i < len(q.msgs) && q.msgs[i] != m {
+		i++
+	}
+	if i == len(q.msgs) {
+		return nil
+	}
+	copy(q.msgs[i:], q.msgs[i+1:])
+	q.msgs[len(q.msgs)-1] = nil
+	q.msgs = q.msgs[:len(q.msgs)-1]
+	if q.f == nil || !m.chat {
+		return nil
+	}
+	if len(q.msgs) == 0 {
+		// Nothing is pending, so start the file over.
+		return q.f.Truncate(0)
+	}
+	return q.record(&queuedMessage{ID: m.ID, Sent: true, chat: true})
+}
+
+// len returns the number of messages waiting to be sent.
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.msgs)
+}
+
+// close closes the queue file, failing any receipts for unsent messages. Unsent chat messages remain in
+// the file.
+func (q *queue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	for _, m := range q.msgs {
+		if m.ack != nil {
+			m.ack.receipt.fail(ErrClosed)
+		}
+	}
+	if q.f == nil {
+		return nil
+	}
+	return q.f.Close()
+}
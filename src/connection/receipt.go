@@ -0,0 +1,144 @@
+package connection
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// How long written messages wait for the server to echo them before we stop looking for the echo.
+	AckTimeout = 2 * time.Minute
+
+	ErrExpired = errors.New("message discarded after waiting too long to be sent")
+	ErrTimeout = errors.New("timed out waiting for delivery")
+)
+
+// A Receipt tracks the delivery of a message sent with SendMessageAck, JoinAck or LeaveAck. A message
+// that was split into several is only written (or acknowledged) once all of its parts are.
+type Receipt struct {
+	mu        sync.Mutex
+	unwritten int
+	unacked   int
+	written   chan struct{}
+	acked     chan struct{}
+	failed    chan struct{}
+	err       error
+}
+
+func newReceipt(parts int) *Receipt {
+	return &Receipt{
+		unwritten: parts,
+		unacked:   parts,
+		written:   make(chan struct{}),
+		acked:     make(chan struct{}),
+		failed:    make(chan struct{}),
+	}
+}
+
+// WaitWritten waits up to timeout for the message to be written to the server and returns nil once it
+// has been.
+func (r *Receipt) WaitWritten(timeout time.Duration) error {
+	return r.wait(r.written, timeout)
+}
+
+// Wait waits up to timeout for the server to echo the message back, which means it has been delivered,
+// and returns nil once it has.
+func (r *Receipt) Wait(timeout time.Duration) error {
+	return r.wait(r.acked, timeout)
+}
+
+func (r *Receipt) wait(done chan struct{}, timeout time.Duration) error {
+	select {
+	case <-done:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-r.failed:
+		return r.err
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+func (r *Receipt) wrote() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unwritten--
+	if r.unwritten == 0 {
+		close(r.written)
+	}
+}
+
+func (r *Receipt) ack() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unacked--
+	if r.unacked == 0 {
+		close(r.acked)
+	}
+}
+
+func (r *Receipt) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil || r.unacked == 0 {
+		return
+	}
+	r.err = err
+	close(r.failed)
+}
+
+// A pendingAck is a written message we expect the server to echo back.
+type pendingAck struct {
+	action  string
+	channel string
+	message string
+	receipt *Receipt
+	written time.Time
+}
+
+// wrote records that a message was written and starts waiting for its echo.
+func (c *Conn) wrote(a *pendingAck) {
+	// Only report the message written once we're looking for its echo, which could arrive any moment.
+	defer a.receipt.wrote()
+	a.written = time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Forget about messages that were never echoed.
+	for len(c.acks) > 0 && time.Since(c.acks[0].written) > AckTimeout {
+		c.acks[0].receipt.fail(ErrTimeout)
+		c.acks = c.acks[1:]
+	}
+	c.acks = append(c.acks, a)
+}
+
+// acked matches a message from the server, which must be from us, against the oldest pending ack for the
+// same message.
+func (c *Conn) acked(action, channel, message string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, a := range c.acks {
+		if a.action == action && a.channel == channel && a.message == message {
+			a.receipt.ack()
+			c.acks = append(c.acks[:i], c.acks[i+1:]...)
+			return
+		}
+	}
+}
+
+// failAcks fails every receipt still waiting for an echo.
+func (c *Conn) failAcks(err error) {
+	c.mu.Lock()
+	acks := c.acks
+	c.acks = nil
+	c.mu.Unlock()
+	for _, a := range acks {
+		a.receipt.fail(err)
+	}
+}
@@ -0,0 +1,61 @@
+package connection
+
+import (
+	"sort"
+	"sync"
+)
+
+// A Set is a group of named connections (for instance, to different Prat servers) that can reach each
+// other with Conn.Peer.
+type Set struct {
+	mu    sync.Mutex
+	conns map[string]*Conn
+}
+
+func NewSet() *Set {
+	return &Set{conns: make(map[string]*Conn)}
+}
+
+// Add puts c in the set under c.Name, replacing any connection with the same name.
+func (s *Set) Add(c *Conn) {
+	s.mu.Lock()
+	s.conns[c.Name] = c
+	s.mu.Unlock()
+	c.mu.Lock()
+	c.set = s
+	c.mu.Unlock()
+}
+
+// Get returns the connection called name, or nil if there isn't one.
+func (s *Set) Get(name string) *Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns[name]
+}
+
+// Names returns the (sorted) names of the connections in the set.
+func (s *Set) Names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.conns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Peer returns the connection called name in c's set, or nil if there is no such connection. A connection
+// is its own peer, so bots can address any connection (including their own) by name.
+func (c *Conn) Peer(name string) *Conn {
+	c.mu.Lock()
+	s := c.set
+	c.mu.Unlock()
+	if s == nil {
+		if name == c.Name {
+			return c
+		}
+		return nil
+	}
+	return s.Get(name)
+}
@@ -0,0 +1,75 @@
+package connection
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// TLSOptions control how the server's certificate is verified and what we present to it.
+type TLSOptions struct {
+	// PEM file of CA certificates to trust instead of the system roots
+	CAFile string
+	// If set, the server must present a certificate whose SHA-256 fingerprint (in hex; colons optional) is
+	// one of these.
+	Pins []string
+	// Client certificate and key (PEM files) to present to the server
+	CertFile string
+	KeyFile  string
+	// Name to verify the server's certificate against, if not the host we dial
+	ServerName string
+	// Skip certificate chain and host name verification. Pins are still checked.
+	Insecure bool
+}
+
+// Config builds a tls.Config from the options. A nil *TLSOptions gives the default configuration.
+func (o *TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{}
+	if o == nil {
+		return config, nil
+	}
+	config.ServerName = o.ServerName
+	config.InsecureSkipVerify = o.Insecure
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(o.Pins) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range o.Pins {
+			b, err := hex.DecodeString(strings.Replace(pin, ":", "", -1))
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("bad certificate pin: %q", pin)
+			}
+			pins[string(b)] = true
+		}
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			for _, raw := range rawCerts {
+				sum := sha256.Sum256(raw)
+				if pins[string(sum[:])] {
+					return nil
+				}
+			}
+			return errors.New("server certificate does not match any pin")
+		}
+	}
+	return config, nil
+}
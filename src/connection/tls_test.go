@@ -0,0 +1,121 @@
+package connection
+
+import (
+	"authutil"
+	"code.google.com/p/go.net/websocket"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tlsEchoServer starts a websocket echo server over TLS, and returns it with its wss:// address.
+func tlsEchoServer(t *testing.T) (*httptest.Server, string) {
+	srv := httptest.NewTLSServer(websocket.Handler(func(ws *websocket.Conn) {
+		var frame string
+		for websocket.Message.Receive(ws, &frame) == nil {
+			websocket.Message.Send(ws, frame)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, "wss" + strings.TrimPrefix(srv.URL, "https")
+}
+
+// pin returns the fingerprint of srv's certificate, with colons between the bytes if colons is set.
+func pin(srv *httptest.Server, colons bool) string {
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	if !colons {
+		return hex.EncodeToString(sum[:])
+	}
+	var parts []string
+	for _, b := range sum {
+		parts = append(parts, hex.EncodeToString([]byte{b}))
+	}
+	return strings.ToUpper(strings.Join(parts, ":"))
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	name = filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestTLS(t *testing.T) {
+	srv, addr := tlsEchoServer(t)
+	caFile := writeFile(t, "ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	// Every httptest server has the same certificate, so the wrong pin can't come from another one.
+	wrongSum := sha256.Sum256([]byte("some other certificate"))
+	wrongPin := hex.EncodeToString(wrongSum[:])
+
+	tests := []struct {
+		name string
+		opts *TLSOptions
+		ok   bool
+	}{
+		{"system roots", nil, false},
+		{"CA file", &TLSOptions{CAFile: caFile}, true},
+		{"server name in certificate", &TLSOptions{CAFile: caFile, ServerName: "example.com"}, true},
+		{"server name not in certificate", &TLSOptions{CAFile: caFile, ServerName: "prat.example.org"}, false},
+		{"insecure", &TLSOptions{Insecure: true}, true},
+		{"insecure, wrong server name", &TLSOptions{Insecure: true, ServerName: "prat.example.org"}, true},
+		{"pin", &TLSOptions{Insecure: true, Pins: []string{pin(srv, false)}}, true},
+		{"pin with colons", &TLSOptions{Insecure: true, Pins: []string{pin(srv, true)}}, true},
+		{"one of the pins", &TLSOptions{Insecure: true, Pins: []string{wrongPin, pin(srv, false)}}, true},
+		{"wrong pin", &TLSOptions{Insecure: true, Pins: []string{wrongPin}}, false},
+		{"wrong pin, trusted CA", &TLSOptions{CAFile: caFile, Pins: []string{wrongPin}}, false},
+		// Pinning doesn't replace verifying the chain unless Insecure is set too.
+		{"pin, untrusted CA", &TLSOptions{Pins: []string{pin(srv, false)}}, false},
+	}
+	for _, test := range tests {
+		tr, err := NewWebsocketTransport(addr, authutil.Static{APIKey: "key", Secret: "secret"}, &Options{TLS: test.opts})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		s, err := tr.Dial()
+		if !test.ok {
+			if err == nil {
+				s.Close()
+				t.Errorf("%s: connected; want a TLS error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if err := s.WriteFrame("hello"); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if frame, err := s.ReadFrame(); err != nil || frame != "hello" {
+			t.Errorf("%s: ReadFrame() = %q, %v", test.name, frame, err)
+		}
+		s.Close()
+	}
+}
+
+func TestTLSOptionsErrors(t *testing.T) {
+	notPEM := writeFile(t, "ca.pem", []byte("not a certificate"))
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	tests := []*TLSOptions{
+		{CAFile: missing},
+		{CAFile: notPEM},
+		{CertFile: missing, KeyFile: missing},
+		{CertFile: notPEM},
+		{Pins: []string{"not hex"}},
+		{Pins: []string{"abcd"}},
+	}
+	for _, o := range tests {
+		if _, err := o.Config(); err == nil {
+			t.Errorf("%+v: no error", o)
+		}
+	}
+	if config, err := (*TLSOptions)(nil).Config(); err != nil || config == nil {
+		t.Errorf("nil options: %v, %v", config, err)
+	}
+}
@@ -0,0 +1,184 @@
+package connection
+
+import (
+	"code.google.com/p/go.net/proxy"
+	"code.google.com/p/go.net/websocket"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"authutil"
+)
+
+// A Transport makes connections to the server. Conn dials it once to start with and again every time it
+// reconnects.
+type Transport interface {
+	Dial() (Socket, error)
+}
+
+// A Socket is a single connection to the server carrying text frames. ReadFrame is only called from one
+// goroutine at a time, but WriteFrame must be safe to call concurrently. Close must unblock any pending
+// ReadFrame.
+type Socket interface {
+	ReadFrame() (string, error)
+	WriteFrame(frame string) error
+	Close() error
+}
+
+// WebsocketTransport connects to a Prat server's eventhub.
+type WebsocketTransport struct {
+	addrString string
+	signer     *authutil.Signer
+	tlsConfig  *tls.Config
+	dialer     proxy.Dialer
+}
+
+// NewWebsocketTransport returns a transport for the server at addrString (ws://host:port or
+// wss://host:port). The credentials are fetched from creds on every dial, so that changes to them take
+// effect the next time we reconnect. Only the TLS and Dialer options are used.
+func NewWebsocketTransport(addrString string, creds authutil.Source, opts *Options) (*WebsocketTransport, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	tlsConfig, err := opts.TLS.Config()
+	if err != nil {
+		return nil, err
+	}
+	t := &WebsocketTransport{
+		addrString: addrString,
+		signer:     &authutil.Signer{Source: creds},
+		tlsConfig:  tlsConfig,
+		dialer:     opts.Dialer,
+	}
+	return t, nil
+}
+
+func (t *WebsocketTransport) Dial() (Socket, error) {
+	route, err := t.signer.SignURL("GET", "/eventhub", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	connectionString := t.addrString + route
+	config, err := websocket.NewConfig(connectionString, "http://localhost")
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = t.tlsConfig
+	ws, conn, err := dialWebsocket(config, t.dialer)
+	if err != nil {
+		return nil, err
+	}
+	return websocketSocket{ws, conn}, nil
+}
+
+// How long closing a websocket may spend trying to write the close frame.
+var closeTimeout = 5 * time.Second
+
+type websocketSocket struct {
+	ws *websocket.Conn
+	// The underlying connection
+	conn net.Conn
+}
+
+func (s websocketSocket) ReadFrame() (string, error) {
+	var frame string
+	err := websocket.Message.Receive(s.ws, &frame)
+	return frame, err
+}
+
+func (s websocketSocket) WriteFrame(frame string) error { return websocket.Message.Send(s.ws, frame) }
+
+// Close writes a close frame and closes the connection. The connection is closed even if the close frame
+// can't be written, and a wedged connection (or a write already stuck on it) only holds it up for
+// closeTimeout.
+func (s websocketSocket) Close() error {
+	s.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	err := s.ws.Close()
+	s.conn.Close()
+	return err
+}
+
+// PipeTransport is an in-memory Transport, mainly for tests. Every Dial creates a new pipe; the client end
+// is returned to the dialer and the server end is handed out by Accept.
+type PipeTransport struct {
+	mu      sync.Mutex
+	dialErr error
+	accept  chan *PipeSocket
+}
+
+func NewPipeTransport() *PipeTransport {
+	return &PipeTransport{accept: make(chan *PipeSocket, 16)}
+}
+
+// FailDials makes subsequent dials fail with err, or succeed again if err is nil.
+func (t *PipeTransport) FailDials(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dialErr = err
+}
+
+func (t *PipeTransport) Dial() (Socket, error) {
+	t.mu.Lock()
+	err := t.dialErr
+	t.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	client, server := NewPipe()
+	t.accept <- server
+	return client, nil
+}
+
+// Accept returns the server end of the next dialed pipe, blocking until there is one.
+func (t *PipeTransport) Accept() *PipeSocket {
+	return <-t.accept
+}
+
+var errPipeClosed = errors.New("pipe closed")
+
+// A PipeSocket is one end of an in-memory socket created by NewPipe.
+type PipeSocket struct {
+	in, out chan string
+	closed  chan struct{}
+	once    *sync.Once
+}
+
+// NewPipe returns the two ends of an in-memory socket. Frames written to one end are read from the other.
+// Closing either end closes both: reads then return io.EOF and writes fail.
+func NewPipe() (*PipeSocket, *PipeSocket) {
+	a, b := make(chan string), make(chan string)
+	closed := make(chan struct{})
+	once := new(sync.Once)
+	return &PipeSocket{a, b, closed, once}, &PipeSocket{b, a, closed, once}
+}
+
+func (p *PipeSocket) ReadFrame() (string, error) {
+	select {
+	case frame := <-p.in:
+		return frame, nil
+	case <-p.closed:
+		return "", io.EOF
+	}
+}
+
+func (p *PipeSocket) WriteFrame(frame string) error {
+	select {
+	case <-p.closed:
+		return errPipeClosed
+	default:
+	}
+	select {
+	case p.out <- frame:
+		return nil
+	case <-p.closed:
+		return errPipeClosed
+	}
+}
+
+func (p *PipeSocket) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
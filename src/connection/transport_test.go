@@ -0,0 +1,92 @@
+package connection
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A breakableConn is a net.Conn whose writes can be made to fail, and which records whether it was closed.
+type breakableConn struct {
+	net.Conn
+	mu     sync.Mutex
+	broken bool
+	closed bool
+}
+
+func (c *breakableConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	broken := c.broken
+	c.mu.Unlock()
+	if broken {
+		return 0, errors.New("broken")
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *breakableConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+type dialerFunc func(network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) { return f(network, addr) }
+
+// echoServer starts a websocket server that echoes frames back, and returns its ws:// address.
+func echoServer(t *testing.T) string {
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		var frame string
+		for websocket.Message.Receive(ws, &frame) == nil {
+			websocket.Message.Send(ws, frame)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+}
+
+func TestWebsocketClose(t *testing.T) {
+	var conn *breakableConn
+	d := dialerFunc(func(network, addr string) (net.Conn, error) {
+		c, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn = &breakableConn{Conn: c}
+		return conn, nil
+	})
+	config, err := websocket.NewConfig(echoServer(t), "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, c, err := dialWebsocket(config, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := websocketSocket{ws, c}
+	if err := s.WriteFrame("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := s.ReadFrame(); err != nil || frame != "hello" {
+		t.Fatalf("ReadFrame() = %q, %v", frame, err)
+	}
+
+	// The connection is closed even though the close frame can't be written.
+	conn.mu.Lock()
+	conn.broken = true
+	conn.mu.Unlock()
+	if err := s.Close(); err == nil {
+		t.Error("Close succeeded without writing the close frame")
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if !conn.closed {
+		t.Error("the underlying connection wasn't closed")
+	}
+}
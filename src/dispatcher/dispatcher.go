@@ -2,50 +2,377 @@ package dispatcher
 
 import (
 	"bot"
+	"connection"
 	"encoding/json"
 	"log"
+	"protocol"
+	"sync"
+	"time"
 )
 
+// Overflow says what to do with an event for a bot whose queue is full.
+type Overflow int
+
+const (
+	// Wait for room in the queue. This holds up every other bot, and the connection (which stops reading, so
+	// it misses pongs and reconnects), until the slow bot catches up.
+	Block Overflow = iota
+	// Discard the oldest queued event to make room.
+	DropOldest
+	// Discard the new event.
+	DropNewest
+)
+
+type Options struct {
+	// How many events may be waiting for each bot
+	QueueSize int
+	Overflow  Overflow
+	// Keep sending events to a bot after it panics (after PanicDelay), rather than stopping it. The bot
+	// isn't recreated, so it has to cope with whatever state the panic left it in.
+	KeepRunning bool
+	PanicDelay  time.Duration
+}
+
+var DefaultOptions = Options{
+	QueueSize:  100,
+	Overflow:   DropOldest,
+	PanicDelay: time.Second,
+}
+
+// Handling an event taking longer than this gets a warning in the log.
+var SlowHandle = 10 * time.Second
+
+// A Dispatcher passes events to bots. Each bot runs on its own goroutine, so a slow (or panicking) bot
+// doesn't affect the others.
 type Dispatcher struct {
-	bots []bot.Bot
+	opts Options
+
+	mu         sync.Mutex
+	workers    []*worker
+	middleware []Middleware
+	// Where to join the channels bots subscribe to, if anywhere
+	conn *connection.Conn
+	// Whether EventConnect has been sent, after which channels have to be joined as they're enabled
+	connected bool
 }
 
 func New() *Dispatcher {
-	return &Dispatcher{}
+	return NewWithOptions(nil)
+}
+
+// NewWithOptions returns a Dispatcher using opts, or DefaultOptions if opts is nil.
+func NewWithOptions(opts *Options) *Dispatcher {
+	if opts == nil {
+		opts = &DefaultOptions
+	}
+	d := &Dispatcher{opts: *opts}
+	if d.opts.QueueSize <= 0 {
+		d.opts.QueueSize = DefaultOptions.QueueSize
+	}
+	return d
+}
+
+// Use adds middleware for every bot registered afterwards. It runs before any bot-specific middleware.
+func (d *Dispatcher) Use(mws ...Middleware) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.middleware = append(d.middleware, mws...)
 }
 
-func (d *Dispatcher) Register(b bot.Bot) {
-	d.bots = append(d.bots, b)
+// Register starts running b, with events passing through the dispatcher's middleware and then mws. name
+// identifies it in logs and Stats.
+func (d *Dispatcher) Register(name string, b bot.Bot, mws ...Middleware) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	all := append(append([]Middleware(nil), d.middleware...), mws...)
+	w := newWorker(name, b, d.opts, all)
+	d.workers = append(d.workers, w)
+	go w.run()
 }
 
+// AutoJoin makes the dispatcher join the channels that bots subscribe to (see bot.Subscriber) on conn,
+// when it sends EventConnect.
+func (d *Dispatcher) AutoJoin(conn *connection.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conn = conn
+}
+
+// Send queues e for every bot that wants it. EventShutdown is queued even for bots whose queues are full,
+// so sending it never blocks.
 func (d *Dispatcher) Send(e *bot.Event) {
-	for _, b := range d.bots {
-		b.Handle(e)
+	d.mu.Lock()
+	workers := d.workers
+	d.mu.Unlock()
+	d.send(workers, e)
+}
+
+// SendTo queues e for the named bot only, if it wants it. It returns false if there's no such bot.
+func (d *Dispatcher) SendTo(name string, e *bot.Event) bool {
+	w := d.worker(name)
+	if w == nil {
+		return false
+	}
+	d.send([]*worker{w}, e)
+	return true
+}
+
+func (d *Dispatcher) send(workers []*worker, e *bot.Event) {
+	if e.Type == bot.EventConnect {
+		d.mu.Lock()
+		conn := d.conn
+		d.connected = true
+		d.mu.Unlock()
+		if conn != nil {
+			joined := make(map[string]bool)
+			for _, w := range workers {
+				for _, c := range w.joins() {
+					if !joined[c] {
+						conn.Join(c)
+						joined[c] = true
+					}
+				}
+			}
+		}
+	}
+	for _, w := range workers {
+		if w.wants(e) {
+			if e.Type == bot.EventConnect {
+				w.mu.Lock()
+				w.connected = true
+				w.mu.Unlock()
+			}
+			w.push(e)
+		}
+	}
+}
+
+// Publish sends a custom event to every bot that subscribes to it, except from. It makes the dispatcher a
+// bot.Bus.
+func (d *Dispatcher) Publish(from, name string, data interface{}) {
+	if name == "" {
+		log.Printf("Warning: %s bot published an event with no name.", from)
+		return
+	}
+	d.mu.Lock()
+	var workers []*worker
+	for _, w := range d.workers {
+		if w.name != from {
+			workers = append(workers, w)
+		}
+	}
+	d.mu.Unlock()
+	d.send(workers, &bot.Event{Type: bot.EventCustom, Payload: bot.Custom{From: from, Name: name, Data: data}})
+}
+
+func (d *Dispatcher) worker(name string) *worker {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, w := range d.workers {
+		if w.name == name {
+			return w
+		}
+	}
+	return nil
+}
+
+// Enable turns the named bot on or off. A disabled bot gets no events (except EventShutdown), so a bot
+// that was disabled when EventConnect was sent gets it when it's enabled. It returns false if there's no
+// such bot.
+func (d *Dispatcher) Enable(name string, enabled bool) bool {
+	w := d.worker(name)
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	w.disabled = !enabled
+	missed := !w.connected
+	w.mu.Unlock()
+	if !enabled {
+		return true
+	}
+	d.mu.Lock()
+	connected := d.connected
+	d.mu.Unlock()
+	if missed && connected {
+		// This joins the bot's channels too.
+		d.send([]*worker{w}, &bot.Event{Type: bot.EventConnect})
+	} else {
+		d.joinNow(w.joins())
 	}
+	return true
 }
 
+// EnableIn makes the named bot hear (or not hear) from channel, whatever its subscription says. It
+// returns false if there's no such bot.
+func (d *Dispatcher) EnableIn(name, channel string, enabled bool) bool {
+	w := d.worker(name)
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	w.overrides[channel] = enabled
+	disabled := w.disabled
+	w.mu.Unlock()
+	if enabled && !disabled {
+		d.joinNow([]string{channel})
+	}
+	return true
+}
+
+// Hears reports whether the named bot is enabled and, unless channel is empty, hears from channel. It makes
+// the dispatcher a bot.Switches.
+func (d *Dispatcher) Hears(name, channel string) bool {
+	w := d.worker(name)
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.disabled && (channel == "" || w.hears(channel))
+}
+
+// joinNow joins channels if we've already connected (before that, it happens with EventConnect).
+func (d *Dispatcher) joinNow(channels []string) {
+	d.mu.Lock()
+	conn := d.conn
+	connected := d.connected
+	d.mu.Unlock()
+	if conn == nil || !connected {
+		return
+	}
+	for _, c := range channels {
+		conn.Join(c)
+	}
+}
+
+// A BotStatus describes a registered bot and where it's listening.
+type BotStatus struct {
+	Name    string
+	Enabled bool
+	// The channels (and patterns) the bot hears from, or nil for all of them
+	Channels []string
+	// Channels the bot has been told not to hear from
+	Excluded []string
+}
+
+// Bots describes all the registered bots.
+func (d *Dispatcher) Bots() []BotStatus {
+	d.mu.Lock()
+	workers := d.workers
+	d.mu.Unlock()
+	var bots []BotStatus
+	for _, w := range workers {
+		bots = append(bots, w.status())
+	}
+	return bots
+}
+
+// Stop waits up to timeout for the bots to handle the events already sent to them, then stops them. Events
+// sent afterwards are dropped. It returns false if some bots were still busy when time ran out.
+func (d *Dispatcher) Stop(timeout time.Duration) bool {
+	d.mu.Lock()
+	workers := d.workers
+	d.mu.Unlock()
+	for _, w := range workers {
+		w.stop()
+	}
+	deadline := time.After(timeout)
+	for _, w := range workers {
+		select {
+		case <-w.done:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
+
+// Stats returns the statistics for each bot by name.
+func (d *Dispatcher) Stats() map[string]Stats {
+	d.mu.Lock()
+	workers := d.workers
+	d.mu.Unlock()
+	stats := make(map[string]Stats)
+	for _, w := range workers {
+		stats[w.name] = w.getStats()
+	}
+	return stats
+}
+
+// SendState sends bots the event corresponding to a connection state change, if there is one.
+func (d *Dispatcher) SendState(s connection.State) {
+	event := &bot.Event{}
+	switch s {
+	case connection.StateDisconnected:
+		event.Type = bot.EventDisconnect
+	case connection.StateConnected:
+		event.Type = bot.EventReconnect
+	default:
+		return
+	}
+	d.Send(event)
+}
+
+// SendRaw decodes a message from the server and sends it through the dispatcher.
 func (d *Dispatcher) SendRaw(msg string) {
-	typ := bot.MessageType{}
-	if err := json.Unmarshal([]byte(msg), &typ); err != nil {
+	e, err := protocol.DecodeString(msg)
+	if err != nil {
 		log.Println("Warning: received bad message:", err)
 		return
 	}
+	d.Deliver(e)
+}
+
+// Deliver sends bots the event corresponding to a message from the server.
+func (d *Dispatcher) Deliver(e protocol.Event) {
 	event := &bot.Event{}
-	switch typ.Type {
-	case "publish_message":
-		m := new(bot.PublishMessage)
-		if err := json.Unmarshal([]byte(msg), m); err != nil {
-			log.Println("Warning: bad publish message:", err)
-			return
-		}
+	switch e := e.(type) {
+	case *protocol.PublishMessage:
+		m := bot.PublishMessage{}
+		m.Data.User = bot.UserFrom(e.User)
+		m.Data.Channel = e.Channel
+		m.Data.Datetime = int(e.Datetime)
+		m.Data.Message = e.Message
 		event.Type = bot.EventPublishMessage
-		event.Payload = *m
-		// Ignore these message types for now
-	case "pong", "join_channel", "leave_channel", "user_active", "user_offline":
+		event.Payload = m
+	case *protocol.JoinChannel:
+		m := bot.JoinChannel{}
+		m.Data.User = bot.UserFrom(e.User)
+		m.Data.Channel = e.Channel
+		event.Type = bot.EventJoinChannel
+		event.Payload = m
+	case *protocol.LeaveChannel:
+		m := bot.LeaveChannel{}
+		m.Data.User = bot.UserFrom(e.User)
+		m.Data.Channel = e.Channel
+		event.Type = bot.EventLeaveChannel
+		event.Payload = m
+	case *protocol.UserActive:
+		m := bot.UserActive{}
+		m.Data.User = bot.UserFrom(e.User)
+		event.Type = bot.EventUserActive
+		event.Payload = m
+	case *protocol.UserOffline:
+		m := bot.UserOffline{}
+		m.Data.User = bot.UserFrom(e.User)
+		event.Type = bot.EventUserOffline
+		event.Payload = m
+	case *protocol.Unknown:
+		event.Type = bot.EventUnknown
+		event.Payload = bot.Unknown{Action: e.Name, Data: e.Data}
+	case *protocol.Ping, *protocol.Pong:
+		// Heartbeats are the connection's business.
 		return
 	default:
-		log.Println("Received unhandled message type:", typ.Type)
-		return
+		// Registered with protocol.Register, but with no bot event type of its own
+		data, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("Warning: couldn't re-encode %s message: %s", e.Action(), err)
+			return
+		}
+		event.Type = bot.EventUnknown
+		event.Payload = bot.Unknown{Action: e.Action(), Data: data}
 	}
 	d.Send(event)
 }
@@ -0,0 +1,319 @@
+package dispatcher
+
+import (
+	"bot"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recorder is a bot that records the types of the events it gets.
+type recorder struct {
+	sub    *bot.Subscription
+	events chan bot.EventType
+}
+
+func newRecorder(types ...bot.EventType) *recorder {
+	return &recorder{&bot.Subscription{Types: types}, make(chan bot.EventType, 100)}
+}
+
+func (r *recorder) Subscription() *bot.Subscription { return r.sub }
+func (r *recorder) Handle(e *bot.Event)             { r.events <- e.Type }
+
+// got stops d and returns the events r was sent.
+func (r *recorder) got(t *testing.T, d *Dispatcher) []bot.EventType {
+	if !d.Stop(time.Second) {
+		t.Fatal("bots didn't finish")
+	}
+	close(r.events)
+	var types []bot.EventType
+	for e := range r.events {
+		types = append(types, e)
+	}
+	return types
+}
+
+func TestEnableSendsMissedConnect(t *testing.T) {
+	d := New()
+	r := newRecorder()
+	d.Register("r", r)
+	d.Enable("r", false)
+	d.Send(&bot.Event{Type: bot.EventConnect})
+	d.Send(&bot.Event{Type: bot.EventPublishMessage})
+	d.Enable("r", true)
+	d.Send(&bot.Event{Type: bot.EventPublishMessage})
+	// It only ever needs one.
+	d.Enable("r", false)
+	d.Enable("r", true)
+	d.Send(&bot.Event{Type: bot.EventShutdown})
+
+	want := []bot.EventType{bot.EventConnect, bot.EventPublishMessage, bot.EventShutdown}
+	if got := r.got(t, d); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestEnableBeforeConnect(t *testing.T) {
+	d := New()
+	r := newRecorder()
+	d.Register("r", r)
+	d.Enable("r", false)
+	d.Enable("r", true)
+	d.Send(&bot.Event{Type: bot.EventConnect})
+
+	want := []bot.EventType{bot.EventConnect}
+	if got := r.got(t, d); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestHears(t *testing.T) {
+	d := New()
+	r := newRecorder()
+	r.sub.Channels = []string{"general", "bot-*"}
+	d.Register("r", r)
+	var switches bot.Switches = d
+	check := func(channel string, want bool) {
+		if got := switches.Hears("r", channel); got != want {
+			t.Errorf("Hears(%q) = %t; want %t", channel, got, want)
+		}
+	}
+	check("", true)
+	check("general", true)
+	check("bot-test", true)
+	check("random", false)
+	if switches.Hears("nobody", "") {
+		t.Error("Hears is true for a bot that doesn't exist")
+	}
+
+	d.EnableIn("r", "general", false)
+	d.EnableIn("r", "random", true)
+	check("general", false)
+	check("random", true)
+
+	d.Enable("r", false)
+	check("", false)
+	check("random", false)
+	d.Stop(time.Second)
+}
+
+// A bot that's stuck with a full queue can't hold up shutting down.
+func TestShutdownStuckBot(t *testing.T) {
+	d := NewWithOptions(&Options{QueueSize: 1, Overflow: Block})
+	stuck := make(chan struct{})
+	defer close(stuck)
+	d.Register("stuck", botFunc(func(e *bot.Event) { <-stuck }))
+
+	d.Send(&bot.Event{Type: bot.EventPublishMessage}) // being handled
+	d.Send(&bot.Event{Type: bot.EventPublishMessage}) // fills the queue
+	blocked := make(chan struct{})
+	go func() {
+		d.Send(&bot.Event{Type: bot.EventPublishMessage})
+		close(blocked)
+	}()
+
+	sent := make(chan struct{})
+	go func() {
+		d.Send(&bot.Event{Type: bot.EventShutdown})
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("sending EventShutdown blocked")
+	}
+	if d.Stop(10 * time.Millisecond) {
+		t.Error("Stop reported a stuck bot as finished")
+	}
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("Stop didn't release a blocked Send")
+	}
+}
+
+type botFunc func(e *bot.Event)
+
+func (f botFunc) Handle(e *bot.Event) { f(e) }
+
+// gated is a bot that records the payloads of the events it gets. It doesn't handle anything until gate is
+// closed, and it panics on the payload "panic".
+type gated struct {
+	started chan struct{}
+	gate    chan struct{}
+	got     []interface{}
+}
+
+func newGated() *gated {
+	return &gated{started: make(chan struct{}, 100), gate: make(chan struct{})}
+}
+
+func (g *gated) Handle(e *bot.Event) {
+	g.started <- struct{}{}
+	<-g.gate
+	if e.Payload == "panic" {
+		panic("test panic")
+	}
+	g.got = append(g.got, e.Payload)
+}
+
+// sendAll registers g and sends it an event for each payload, the first of which it starts handling before
+// the rest are sent.
+func (g *gated) sendAll(t *testing.T, d *Dispatcher, payloads ...interface{}) {
+	d.Register("g", g)
+	d.Send(&bot.Event{Type: bot.EventPublishMessage, Payload: payloads[0]})
+	select {
+	case <-g.started:
+	case <-time.After(time.Second):
+		t.Fatal("bot didn't start handling the first event")
+	}
+	for _, p := range payloads[1:] {
+		d.Send(&bot.Event{Type: bot.EventPublishMessage, Payload: p})
+	}
+}
+
+// finish lets g handle its events and stops d, returning the payloads g got.
+func (g *gated) finish(t *testing.T, d *Dispatcher) []interface{} {
+	close(g.gate)
+	if !d.Stop(time.Second) {
+		t.Fatal("bot didn't finish")
+	}
+	return g.got
+}
+
+func TestOverflow(t *testing.T) {
+	for _, tt := range []struct {
+		overflow Overflow
+		want     []interface{}
+	}{
+		{DropOldest, []interface{}{1, 4, 5}},
+		{DropNewest, []interface{}{1, 2, 3}},
+	} {
+		d := NewWithOptions(&Options{QueueSize: 2, Overflow: tt.overflow})
+		g := newGated()
+		g.sendAll(t, d, 1, 2, 3, 4, 5)
+		if s := d.Stats()["g"]; s.Queued != 2 || s.Dropped != 2 {
+			t.Errorf("overflow %d: Stats() = %+v while stuck; want 2 queued and 2 dropped", tt.overflow, s)
+		}
+		if got := g.finish(t, d); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("overflow %d: got %v; want %v", tt.overflow, got, tt.want)
+		}
+	}
+}
+
+func TestPanic(t *testing.T) {
+	for _, tt := range []struct {
+		keepRunning bool
+		want        []interface{}
+		dropped     int
+	}{
+		// The bot is stopped, and what was queued for it is dropped.
+		{false, []interface{}{1}, 2},
+		{true, []interface{}{1, 3, 4}, 0},
+	} {
+		d := NewWithOptions(&Options{QueueSize: 10, KeepRunning: tt.keepRunning})
+		g := newGated()
+		g.sendAll(t, d, 1, "panic", 3, 4)
+		got := g.finish(t, d)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("KeepRunning %t: got %v; want %v", tt.keepRunning, got, tt.want)
+		}
+		s := d.Stats()["g"]
+		if s.Panics != 1 || s.Dropped != tt.dropped || s.Handled != len(tt.want)+1 {
+			t.Errorf("KeepRunning %t: Stats() = %+v; want 1 panic, %d dropped and %d handled",
+				tt.keepRunning, s, tt.dropped, len(tt.want)+1)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	d := New()
+	d.Register("slow", botFunc(func(e *bot.Event) { time.Sleep(10 * time.Millisecond) }))
+	d.Register("fast", botFunc(func(e *bot.Event) {}))
+	for i := 0; i < 3; i++ {
+		d.Send(&bot.Event{Type: bot.EventPublishMessage})
+	}
+	if !d.Stop(time.Second) {
+		t.Fatal("bots didn't finish")
+	}
+	stats := d.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("Stats() has %d bots; want 2", len(stats))
+	}
+	s := stats["slow"]
+	if s.Handled != 3 || s.Dropped != 0 || s.Panics != 0 || s.Queued != 0 {
+		t.Errorf("Stats() = %+v; want 3 handled", s)
+	}
+	if s.Last < 10*time.Millisecond || s.Max < s.Last || s.Total < 3*10*time.Millisecond {
+		t.Errorf("Stats() = %+v; want times of at least 10ms an event", s)
+	}
+	if s := stats["fast"]; s.Handled != 3 {
+		t.Errorf("Stats() = %+v for the fast bot; want 3 handled", s)
+	}
+
+	// Events sent after stopping are dropped.
+	d.Send(&bot.Event{Type: bot.EventPublishMessage})
+	if s := d.Stats()["fast"]; s.Handled != 3 || s.Dropped != 1 {
+		t.Errorf("Stats() = %+v after stopping; want 1 dropped", s)
+	}
+}
+
+// listener is a bot that records the custom events it gets, as "from:name:data".
+type listener struct {
+	sub    *bot.Subscription
+	events chan string
+}
+
+func newListener(events ...string) *listener {
+	return &listener{&bot.Subscription{Events: events}, make(chan string, 100)}
+}
+
+func (l *listener) Subscription() *bot.Subscription { return l.sub }
+func (l *listener) Handle(e *bot.Event) {
+	if c, ok := e.Payload.(bot.Custom); ok {
+		l.events <- fmt.Sprintf("%s:%s:%v", c.From, c.Name, c.Data)
+	}
+}
+
+func (l *listener) got() []string {
+	close(l.events)
+	var events []string
+	for e := range l.events {
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestPublish(t *testing.T) {
+	d := New()
+	listeners := map[string]*listener{
+		"github": newListener("github.*"),
+		"all":    newListener(),
+		"deploy": newListener("deploy", "github.push"),
+	}
+	for name, l := range listeners {
+		d.Register(name, l)
+	}
+	d.Publish("github", "github.push", 1)
+	d.Publish("all", "github.pull_request", 2)
+	d.Publish("deploy", "deploy", 3)
+	d.Publish("other", "deploy.done", 4)
+	d.Publish("other", "", 5)
+	if !d.Stop(time.Second) {
+		t.Fatal("bots didn't finish")
+	}
+
+	want := map[string][]string{
+		// Never its own events, even ones it subscribes to.
+		"github": {"all:github.pull_request:2"},
+		// No Events means all of them.
+		"all":    {"github:github.push:1", "deploy:deploy:3", "other:deploy.done:4"},
+		"deploy": {"github:github.push:1"},
+	}
+	for name, l := range listeners {
+		if got := l.got(); !reflect.DeepEqual(got, want[name]) {
+			t.Errorf("%s got %q; want %q", name, got, want[name])
+		}
+	}
+}
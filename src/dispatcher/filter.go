@@ -0,0 +1,125 @@
+package dispatcher
+
+import (
+	"bot"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A filter decides which events a bot gets, according to its subscription.
+type filter struct {
+	types    map[bot.EventType]bool
+	channels map[string]bool
+	patterns []string
+	// Custom event names and patterns
+	events []string
+}
+
+// newFilter returns the filter for b, or nil if b wants every event.
+func newFilter(b bot.Bot) *filter {
+	s, ok := b.(bot.Subscriber)
+	if !ok {
+		return nil
+	}
+	sub := s.Subscription()
+	if sub == nil {
+		return nil
+	}
+	f := &filter{}
+	if len(sub.Types) > 0 {
+		f.types = make(map[bot.EventType]bool)
+		for _, t := range sub.Types {
+			f.types[t] = true
+		}
+	}
+	f.events = sub.Events
+	if len(sub.Channels) > 0 {
+		f.channels = make(map[string]bool)
+		for _, c := range sub.Channels {
+			if isPattern(c) {
+				f.patterns = append(f.patterns, c)
+			} else {
+				f.channels[c] = true
+			}
+		}
+	}
+	return f
+}
+
+func isPattern(channel string) bool {
+	return strings.ContainsAny(channel, `*?[\`)
+}
+
+func (f *filter) wants(e *bot.Event) bool {
+	if !f.wantsType(e.Type) || !f.wantsEvent(e) {
+		return false
+	}
+	channel, ok := eventChannel(e)
+	return !ok || f.wantsChannel(channel)
+}
+
+func (f *filter) wantsType(t bot.EventType) bool {
+	return f == nil || f.types == nil || f.types[t]
+}
+
+// wantsEvent reports whether a custom event is one the bot subscribes to. Other events always are.
+func (f *filter) wantsEvent(e *bot.Event) bool {
+	c, ok := e.Payload.(bot.Custom)
+	if !ok || f == nil || len(f.events) == 0 {
+		return true
+	}
+	for _, p := range f.events {
+		if ok, _ := path.Match(p, c.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *filter) wantsChannel(channel string) bool {
+	if f == nil || f.channels == nil || f.channels[channel] {
+		return true
+	}
+	for _, p := range f.patterns {
+		if ok, _ := path.Match(p, channel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// join returns the channels named (not matched by patterns) in the subscription.
+func (f *filter) join() []string {
+	if f == nil {
+		return nil
+	}
+	var channels []string
+	for c := range f.channels {
+		channels = append(channels, c)
+	}
+	return channels
+}
+
+// describe returns the channel names and patterns in the subscription, or nil for all channels.
+func (f *filter) describe() []string {
+	if f == nil || f.channels == nil {
+		return nil
+	}
+	channels := append(f.join(), f.patterns...)
+	sort.Strings(channels)
+	return channels
+}
+
+// eventChannel returns the channel an event happened in, if it's that kind of event.
+func eventChannel(e *bot.Event) (string, bool) {
+	switch p := e.Payload.(type) {
+	case bot.PublishMessage:
+		return p.Data.Channel, true
+	case bot.JoinChannel:
+		return p.Data.Channel, true
+	case bot.LeaveChannel:
+		return p.Data.Channel, true
+	}
+	return "", false
+}
@@ -0,0 +1,140 @@
+package dispatcher
+
+import (
+	"bot"
+	"fmt"
+	"log"
+	"path"
+	"ratelimit"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Handler delivers an event to a bot.
+type Handler func(e *bot.Event)
+
+// A Middleware wraps the delivery of events to the bot called name. It can drop an event by not calling
+// next.
+type Middleware func(name string, next Handler) Handler
+
+// chain wraps h in mws, so that the first middleware is the outermost.
+func chain(name string, h Handler, mws []Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](name, h)
+	}
+	return h
+}
+
+// eventUser returns the user who caused an event, if any.
+func eventUser(e *bot.Event) *bot.User {
+	switch p := e.Payload.(type) {
+	case bot.PublishMessage:
+		return p.Data.User
+	case bot.JoinChannel:
+		return p.Data.User
+	case bot.LeaveChannel:
+		return p.Data.User
+	case bot.UserActive:
+		return p.Data.User
+	case bot.UserOffline:
+		return p.Data.User
+	}
+	return nil
+}
+
+// IgnoreSelf drops the messages we sent ourselves (as the user in ui), going by username like the
+// connection does. If ui has no username, nothing is dropped.
+func IgnoreSelf(ui *bot.UserInfo) Middleware {
+	return func(name string, next Handler) Handler {
+		return func(e *bot.Event) {
+			m, ok := e.Payload.(bot.PublishMessage)
+			if ok && m.Data.User != nil && ui.User.Username != "" && m.Data.User.Username == ui.User.Username {
+				return
+			}
+			next(e)
+		}
+	}
+}
+
+// LogEvents logs every event delivered, with the time the bot took to handle it, as key=value pairs.
+func LogEvents(name string, next Handler) Handler {
+	return func(e *bot.Event) {
+		fields := []string{"bot=" + name, "event=" + e.Type.String()}
+		if channel, ok := eventChannel(e); ok {
+			fields = append(fields, fmt.Sprintf("channel=%q", channel))
+		}
+		if c, ok := e.Payload.(bot.Custom); ok {
+			fields = append(fields, fmt.Sprintf("name=%q", c.Name), fmt.Sprintf("from=%q", c.From))
+		}
+		if u := eventUser(e); u != nil && u.Username != "" {
+			fields = append(fields, fmt.Sprintf("user=%q", u.Username))
+		}
+		start := time.Now()
+		next(e)
+		fields = append(fields, "took="+time.Since(start).String())
+		log.Println(strings.Join(fields, " "))
+	}
+}
+
+// RateLimitUsers limits how many messages from each user are delivered, allowing bursts of up to burst
+// messages and rate messages per second after that. Messages over the limit are dropped.
+func RateLimitUsers(rate float64, burst int) Middleware {
+	return func(name string, next Handler) Handler {
+		var mu sync.Mutex
+		buckets := make(map[string]*ratelimit.Bucket)
+		return func(e *bot.Event) {
+			m, ok := e.Payload.(bot.PublishMessage)
+			if !ok {
+				next(e)
+				return
+			}
+			mu.Lock()
+			b, ok := buckets[m.Data.User.Username]
+			if !ok {
+				b = ratelimit.NewBucket(rate, burst)
+				buckets[m.Data.User.Username] = b
+			}
+			allowed := b.Allow(time.Now())
+			mu.Unlock()
+			if !allowed {
+				log.Printf("%s bot: dropping message from %s (over the rate limit).", name, m.Data.User.Username)
+				return
+			}
+			next(e)
+		}
+	}
+}
+
+// AllowChannels only delivers channel events (messages, joins and leaves) from channels matching one of
+// patterns (see path.Match).
+func AllowChannels(patterns ...string) Middleware {
+	return channelFilter(patterns, true)
+}
+
+// DenyChannels drops channel events from channels matching any of patterns.
+func DenyChannels(patterns ...string) Middleware {
+	return channelFilter(patterns, false)
+}
+
+func channelFilter(patterns []string, allow bool) Middleware {
+	return func(name string, next Handler) Handler {
+		return func(e *bot.Event) {
+			channel, ok := eventChannel(e)
+			if !ok {
+				next(e)
+				return
+			}
+			matched := false
+			for _, p := range patterns {
+				if ok, _ := path.Match(p, channel); ok {
+					matched = true
+					break
+				}
+			}
+			if matched == allow {
+				next(e)
+			}
+		}
+	}
+}
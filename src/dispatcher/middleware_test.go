@@ -0,0 +1,122 @@
+package dispatcher
+
+import (
+	"bot"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func message(user, channel, text string) *bot.Event {
+	m := bot.PublishMessage{}
+	m.Data.User = &bot.User{Username: user}
+	m.Data.Channel = channel
+	m.Data.Message = text
+	return &bot.Event{Type: bot.EventPublishMessage, Payload: m}
+}
+
+func join(user, channel string) *bot.Event {
+	m := bot.JoinChannel{}
+	m.Data.User = &bot.User{Username: user}
+	m.Data.Channel = channel
+	return &bot.Event{Type: bot.EventJoinChannel, Payload: m}
+}
+
+// passed runs events through mws and returns the ones that get to the end, by the index of the event.
+func passed(mws []Middleware, events ...*bot.Event) []int {
+	var got []int
+	var current int
+	h := chain("test", func(e *bot.Event) { got = append(got, current) }, mws)
+	for i, e := range events {
+		current = i
+		h(e)
+	}
+	return got
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	mw := func(label string) Middleware {
+		return func(name string, next Handler) Handler {
+			return func(e *bot.Event) {
+				calls = append(calls, label+" "+name)
+				next(e)
+			}
+		}
+	}
+	h := chain("echo", func(e *bot.Event) { calls = append(calls, "bot") }, []Middleware{mw("first"), mw("second")})
+	h(&bot.Event{})
+	if want := []string{"first echo", "second echo", "bot"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("called %q; want %q", calls, want)
+	}
+
+	// The dispatcher's middleware comes before the bot's own.
+	calls = nil
+	d := New()
+	d.Use(mw("global"))
+	d.Register("echo", botFunc(func(e *bot.Event) { calls = append(calls, "bot") }), mw("own"))
+	d.Send(&bot.Event{Type: bot.EventConnect})
+	d.Stop(time.Second)
+	if want := []string{"global echo", "own echo", "bot"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("called %q; want %q", calls, want)
+	}
+}
+
+func TestChannelFilters(t *testing.T) {
+	events := []*bot.Event{
+		message("alice", "general", "hi"),
+		message("alice", "bot-test", "hi"),
+		join("alice", "random"),
+		{Type: bot.EventConnect},
+	}
+	for _, tt := range []struct {
+		name string
+		mws  []Middleware
+		want []int
+	}{
+		{"allow", []Middleware{AllowChannels("general", "random")}, []int{0, 2, 3}},
+		{"allow pattern", []Middleware{AllowChannels("bot-*")}, []int{1, 3}},
+		{"deny", []Middleware{DenyChannels("general")}, []int{1, 2, 3}},
+		{"deny pattern", []Middleware{DenyChannels("bot-*", "random")}, []int{0, 3}},
+		{"both", []Middleware{AllowChannels("general", "bot-*"), DenyChannels("bot-*")}, []int{0, 3}},
+	} {
+		if got := passed(tt.mws, events...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: passed %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitUsers(t *testing.T) {
+	got := passed([]Middleware{RateLimitUsers(0.001, 2)},
+		message("alice", "general", "1"),
+		message("alice", "general", "2"),
+		message("bob", "general", "1"),
+		message("alice", "random", "3"),
+		join("alice", "general"),
+		message("bob", "general", "2"),
+		message("bob", "general", "3"),
+	)
+	if want := []int{0, 1, 2, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("passed %v; want %v", got, want)
+	}
+}
+
+func TestIgnoreSelf(t *testing.T) {
+	events := []*bot.Event{
+		message("pratbot", "general", "mine"),
+		message("alice", "general", "hers"),
+		message("", "general", "anonymous"),
+		join("pratbot", "general"),
+		{Type: bot.EventPublishMessage, Payload: bot.PublishMessage{}},
+	}
+	us := &bot.UserInfo{User: &bot.User{Username: "pratbot"}}
+	if got, want := passed([]Middleware{IgnoreSelf(us)}, events...), []int{1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("passed %v; want %v", got, want)
+	}
+	// Without a username, we can't tell which messages are ours, and users without email addresses aren't
+	// mistaken for us.
+	nobody := &bot.UserInfo{User: &bot.User{}}
+	if got, want := passed([]Middleware{IgnoreSelf(nobody)}, events...), []int{0, 1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("passed %v without a username; want %v", got, want)
+	}
+}
@@ -0,0 +1,248 @@
+package dispatcher
+
+import (
+	"bot"
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stats describes the events a bot has handled.
+type Stats struct {
+	Handled int
+	// Events discarded because the bot's queue was full (or it had stopped after a panic)
+	Dropped int
+	Panics  int
+	// Events waiting to be handled
+	Queued int
+	// Time spent in Handle: in total, the longest for a single event, and for the latest event
+	Total, Max, Last time.Duration
+}
+
+// A worker runs a single bot, feeding it events from its queue.
+type worker struct {
+	name   string
+	bot    bot.Bot
+	opts   Options
+	filter *filter
+	// The bot's Handle, wrapped in middleware
+	handler Handler
+
+	mu sync.Mutex
+	// Signaled when events are added to or removed from the queue, or when the worker is stopped
+	cond    *sync.Cond
+	queue   []*bot.Event
+	stopped bool
+	// Set when the bot has panicked and isn't being restarted
+	dead bool
+	// Whether we've dropped events since the queue was last empty (so we only complain once)
+	dropping bool
+	// Changes made with Dispatcher.Enable and EnableIn: whether the bot is turned off, and channels it
+	// should (true) or shouldn't (false) hear from regardless of its subscription
+	disabled  bool
+	overrides map[string]bool
+	// Whether the bot has been sent EventConnect
+	connected bool
+	stats     Stats
+	done      chan struct{}
+}
+
+func newWorker(name string, b bot.Bot, opts Options, mws []Middleware) *worker {
+	w := &worker{
+		name:      name,
+		bot:       b,
+		opts:      opts,
+		filter:    newFilter(b),
+		overrides: make(map[string]bool),
+		done:      make(chan struct{}),
+	}
+	w.handler = chain(name, b.Handle, mws)
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// wants reports whether the bot should get e. Disabled bots still hear about shutdown, so they can clean
+// up.
+func (w *worker) wants(e *bot.Event) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.disabled && e.Type != bot.EventShutdown {
+		return false
+	}
+	if !w.filter.wantsType(e.Type) || !w.filter.wantsEvent(e) {
+		return false
+	}
+	channel, ok := eventChannel(e)
+	return !ok || w.hears(channel)
+}
+
+// hears reports whether the bot should get events from channel. w.mu must be held.
+func (w *worker) hears(channel string) bool {
+	if hear, ok := w.overrides[channel]; ok {
+		return hear
+	}
+	return w.filter.wantsChannel(channel)
+}
+
+// joins returns the channels the bot should be in.
+func (w *worker) joins() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.disabled {
+		return nil
+	}
+	var channels []string
+	for _, c := range w.filter.join() {
+		if hear, ok := w.overrides[c]; !ok || hear {
+			channels = append(channels, c)
+		}
+	}
+	for c, hear := range w.overrides {
+		if hear && (w.filter == nil || !w.filter.channels[c]) {
+			channels = append(channels, c)
+		}
+	}
+	return channels
+}
+
+func (w *worker) status() BotStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := BotStatus{Name: w.name, Enabled: !w.disabled}
+	if subscribed := w.filter.describe(); subscribed != nil {
+		s.Channels = []string{}
+		for _, c := range subscribed {
+			if hear, ok := w.overrides[c]; !ok || hear {
+				s.Channels = append(s.Channels, c)
+			}
+		}
+	}
+	for c, hear := range w.overrides {
+		if !hear {
+			s.Excluded = append(s.Excluded, c)
+		} else if s.Channels != nil && !w.filter.wantsChannel(c) {
+			s.Channels = append(s.Channels, c)
+		}
+	}
+	sort.Strings(s.Channels)
+	sort.Strings(s.Excluded)
+	return s
+}
+
+// push adds e to the queue, applying the overflow policy if it's full.
+func (w *worker) push(e *bot.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Shutting down mustn't wait for a stuck bot, or lose the event to DropNewest.
+	limited := e.Type != bot.EventShutdown
+	for limited && len(w.queue) >= w.opts.QueueSize && !w.stopped && !w.dead {
+		switch w.opts.Overflow {
+		case DropNewest:
+			w.dropped()
+			return
+		case DropOldest:
+			w.queue[0] = nil
+			w.queue = w.queue[1:]
+			w.dropped()
+		default:
+			w.cond.Wait()
+		}
+	}
+	if w.stopped || w.dead {
+		w.stats.Dropped++
+		return
+	}
+	w.queue = append(w.queue, e)
+	w.cond.Broadcast()
+}
+
+func (w *worker) dropped() {
+	w.stats.Dropped++
+	if !w.dropping {
+		log.Printf("Warning: %s bot is falling behind; dropping events.", w.name)
+		w.dropping = true
+	}
+}
+
+// stop makes the worker exit once its queue is empty.
+func (w *worker) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	w.cond.Broadcast()
+}
+
+func (w *worker) run() {
+	defer close(w.done)
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && !w.stopped {
+			w.cond.Wait()
+		}
+		if len(w.queue) == 0 || w.dead {
+			w.mu.Unlock()
+			return
+		}
+		e := w.queue[0]
+		w.queue[0] = nil
+		w.queue = w.queue[1:]
+		if len(w.queue) == 0 {
+			w.dropping = false
+		}
+		w.cond.Broadcast()
+		w.mu.Unlock()
+
+		w.handle(e)
+	}
+}
+
+// handle passes e to the bot, timing it and recovering from any panic.
+func (w *worker) handle(e *bot.Event) {
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		r := recover()
+		w.mu.Lock()
+		w.stats.Handled++
+		w.stats.Total += elapsed
+		w.stats.Last = elapsed
+		if elapsed > w.stats.Max {
+			w.stats.Max = elapsed
+		}
+		if r != nil {
+			w.stats.Panics++
+			if !w.opts.KeepRunning {
+				w.dead = true
+				w.stats.Dropped += len(w.queue)
+				w.queue = nil
+				w.cond.Broadcast()
+			}
+		}
+		w.mu.Unlock()
+
+		if elapsed > SlowHandle {
+			log.Printf("Warning: %s bot took %s to handle an event (%s).", w.name, elapsed, e.Type)
+		}
+		if r == nil {
+			return
+		}
+		log.Printf("Error: %s bot panicked handling an event (%s): %v\n%s", w.name, e.Type, r, debug.Stack())
+		if w.opts.KeepRunning {
+			log.Printf("Carrying on with %s bot in %s.", w.name, w.opts.PanicDelay)
+			time.Sleep(w.opts.PanicDelay)
+		} else {
+			log.Printf("Stopped %s bot.", w.name)
+		}
+	}()
+	w.handler(e)
+}
+
+func (w *worker) getStats() Stats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.stats
+	s.Queued = len(w.queue)
+	return s
+}
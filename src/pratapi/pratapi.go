@@ -0,0 +1,158 @@
+// Package pratapi is a client for the Prat server's REST API.
+package pratapi
+
+import (
+	"code.google.com/p/go.net/proxy"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"authutil"
+	"protocol"
+)
+
+// How long requests may take, including reading the response
+var Timeout = 30 * time.Second
+
+// Client makes signed requests to a Prat server.
+type Client struct {
+	baseURL string
+	client  *http.Client
+}
+
+// New returns a client for the server at baseURL (e.g. https://pratchat.com:443). tlsConfig and dialer may
+// be nil to use the defaults.
+func New(baseURL, apiKey, secret string, tlsConfig *tls.Config, dialer proxy.Dialer) *Client {
+	return NewWithCredentials(baseURL, authutil.Static{APIKey: apiKey, Secret: secret}, tlsConfig, dialer)
+}
+
+// NewWithCredentials is like New, but gets the credentials from creds for every request.
+func NewWithCredentials(baseURL string, creds authutil.Source, tlsConfig *tls.Config, dialer proxy.Dialer) *Client {
+	base := &http.Transport{TLSClientConfig: tlsConfig}
+	if dialer != nil {
+		base.Dial = dialer.Dial
+	}
+	transport := &authutil.Transport{
+		Signer: &authutil.Signer{Source: creds},
+		Base:   base,
+	}
+	return &Client{
+		baseURL: baseURL,
+		client:  &http.Client{Transport: transport, Timeout: Timeout},
+	}
+}
+
+// Error is returned for responses with a non-2xx status.
+type Error struct {
+	StatusCode int
+	// The error message from the server, if it gave one
+	Message string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("prat API error: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// get makes a signed GET request and decodes the JSON response into v.
+func (c *Client) get(path string, query url.Values, v interface{}) error {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	resp, err := c.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("prat API: bad response from %s: %s", path, err)
+	}
+	return nil
+}
+
+// decodeError makes an *Error out of a failed response. The server may explain itself with JSON of the
+// form {"error": "..."} or with plain text.
+func decodeError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	e := &Error{StatusCode: resp.StatusCode}
+	var j struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &j) == nil && j.Error != "" {
+		e.Message = j.Error
+	} else {
+		e.Message = string(body)
+	}
+	return e
+}
+
+// WhoAmI returns the user our credentials belong to, including the channels they're in.
+func (c *Client) WhoAmI() (*protocol.User, error) {
+	var resp struct {
+		User *protocol.User `json:"user"`
+	}
+	if err := c.get("/api/whoami", nil, &resp); err != nil {
+		return nil, err
+	}
+	if resp.User == nil {
+		return nil, fmt.Errorf("prat API: no user in whoami response")
+	}
+	return resp.User, nil
+}
+
+// Channels lists all the channels on the server.
+func (c *Client) Channels() ([]string, error) {
+	var resp struct {
+		Channels []string `json:"channels"`
+	}
+	if err := c.get("/api/channels", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Channels, nil
+}
+
+// User looks up a user by username.
+func (c *Client) User(username string) (*protocol.User, error) {
+	var resp struct {
+		User *protocol.User `json:"user"`
+	}
+	if err := c.get("/api/user", url.Values{"username": {username}}, &resp); err != nil {
+		return nil, err
+	}
+	if resp.User == nil {
+		return nil, fmt.Errorf("prat API: no user in response")
+	}
+	return resp.User, nil
+}
+
+// Messages returns up to limit of the most recent messages in channel from before the given time (or the
+// most recent ones overall, if before is zero), oldest first.
+func (c *Client) Messages(channel string, before time.Time, limit int) ([]*protocol.PublishMessage, error) {
+	query := url.Values{"channel": {channel}}
+	if !before.IsZero() {
+		query.Set("before", strconv.FormatInt(before.Unix(), 10))
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var resp struct {
+		Messages []*protocol.PublishMessage `json:"messages"`
+	}
+	if err := c.get("/api/messages", query, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
@@ -0,0 +1,481 @@
+// Package prattest provides a fake, in-process Prat server for testing bots without a real one.
+package prattest
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"authutil"
+	"protocol"
+)
+
+// A User is an account on the fake server.
+type User struct {
+	APIKey   string
+	Secret   string
+	Username string
+	Email    string
+	Name     string
+	Gravatar string
+}
+
+// A Message is a chat message published on the server.
+type Message struct {
+	User     *User
+	Channel  string
+	Message  string
+	Datetime int64
+}
+
+// Server is a fake Prat server. It serves the REST API (/api/whoami, /api/channels, /api/user and
+// /api/messages) and the /eventhub websocket, requiring requests to be signed with a registered user's
+// credentials. It keeps track of which channels each user is in and sends
+// published messages to the members of the channel.
+type Server struct {
+	// Addr is the host:port the server listens on.
+	Addr string
+
+	ts *httptest.Server
+
+	mu       sync.Mutex
+	cond     *sync.Cond // Signaled when messages are published or clients come and go
+	users    map[string]*User
+	channels map[*User]map[string]bool
+	clients  map[*client]bool
+	messages []Message
+}
+
+// NewServer starts a fake server. Callers should Close it when they're done.
+func NewServer() *Server {
+	s := &Server{
+		users:    make(map[string]*User),
+		channels: make(map[*User]map[string]bool),
+		clients:  make(map[*client]bool),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/whoami", s.whoami)
+	mux.HandleFunc("/api/channels", s.listChannels)
+	mux.HandleFunc("/api/user", s.lookupUser)
+	mux.HandleFunc("/api/messages", s.history)
+	mux.HandleFunc("/eventhub", s.eventhub)
+	s.ts = httptest.NewServer(mux)
+	s.Addr = strings.TrimPrefix(s.ts.URL, "http://")
+	return s
+}
+
+// WSAddr returns the address to pass to connection.Connect.
+func (s *Server) WSAddr() string { return "ws://" + s.Addr }
+
+// HTTPAddr returns the base URL of the server's API.
+func (s *Server) HTTPAddr() string { return s.ts.URL }
+
+// Close drops all connections and stops the server.
+func (s *Server) Close() {
+	s.DropConnections()
+	s.ts.Close()
+}
+
+// AddUser registers u, whose APIKey and Secret can then be used to sign requests.
+func (s *Server) AddUser(u *User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.APIKey] = u
+	s.channels[u] = make(map[string]bool)
+}
+
+// authenticate checks r's signature and returns the user who signed it.
+func (s *Server) authenticate(r *http.Request) (*User, error) {
+	v := &authutil.Verifier{
+		Lookup: func(apiKey string) (string, bool) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			u, ok := s.users[apiKey]
+			if !ok {
+				return "", false
+			}
+			return u.Secret, true
+		},
+	}
+	apiKey, err := v.Verify(r)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.users[apiKey], nil
+}
+
+func (s *Server) whoami(w http.ResponseWriter, r *http.Request) {
+	u, err := s.authenticate(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	writeJSON(w, map[string]*protocol.User{"user": s.protocolUser(u, true)})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func (s *Server) listChannels(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.authenticate(r); err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	s.mu.Lock()
+	seen := make(map[string]bool)
+	for _, channels := range s.channels {
+		for c := range channels {
+			seen[c] = true
+		}
+	}
+	for _, m := range s.messages {
+		seen[m.Channel] = true
+	}
+	s.mu.Unlock()
+	channels := []string{}
+	for c := range seen {
+		channels = append(channels, c)
+	}
+	sort.Strings(channels)
+	writeJSON(w, map[string][]string{"channels": channels})
+}
+
+func (s *Server) lookupUser(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.authenticate(r); err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	username := r.URL.Query().Get("username")
+	s.mu.Lock()
+	var found *User
+	for _, u := range s.users {
+		if u.Username == username {
+			found = u
+		}
+	}
+	s.mu.Unlock()
+	if found == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such user: %s", username))
+		return
+	}
+	writeJSON(w, map[string]*protocol.User{"user": s.protocolUser(found, true)})
+}
+
+func (s *Server) history(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.authenticate(r); err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	query := r.URL.Query()
+	channel := query.Get("channel")
+	var before int64
+	if b := query.Get("before"); b != "" {
+		before, _ = strconv.ParseInt(b, 10, 64)
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	var msgs []Message
+	for _, m := range s.Messages() {
+		if m.Channel == channel && (before == 0 || m.Datetime < before) {
+			msgs = append(msgs, m)
+		}
+	}
+	if limit > 0 && len(msgs) > limit {
+		msgs = msgs[len(msgs)-limit:]
+	}
+	events := []*protocol.PublishMessage{}
+	for _, m := range msgs {
+		events = append(events, &protocol.PublishMessage{
+			User:     s.protocolUser(m.User, false),
+			Channel:  m.Channel,
+			Datetime: m.Datetime,
+			Message:  m.Message,
+		})
+	}
+	writeJSON(w, map[string][]*protocol.PublishMessage{"messages": events})
+}
+
+func (s *Server) protocolUser(u *User, withChannels bool) *protocol.User {
+	p := &protocol.User{
+		Username: u.Username,
+		Email:    u.Email,
+		Name:     u.Name,
+		Gravatar: u.Gravatar,
+	}
+	if withChannels {
+		p.Channels = s.Channels(u)
+	}
+	return p
+}
+
+// Channels returns the (sorted) channels u is in.
+func (s *Server) Channels(u *User) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var channels []string
+	for c := range s.channels[u] {
+		channels = append(channels, c)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// Join puts u in channel, as if they had joined from another client.
+func (s *Server) Join(u *User, channel string) {
+	s.setMember(u, channel, true)
+}
+
+// Leave takes u out of channel, as if they had left from another client.
+func (s *Server) Leave(u *User, channel string) {
+	s.setMember(u, channel, false)
+}
+
+// Members returns the (sorted) usernames of the users in channel.
+func (s *Server) Members(channel string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, u := range s.members(channel) {
+		names = append(names, u.Username)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setMember adds u to channel or removes them from it, and tells u and the channel's members.
+func (s *Server) setMember(u *User, channel string, member bool) {
+	s.mu.Lock()
+	if member {
+		s.channels[u][channel] = true
+	} else {
+		delete(s.channels[u], channel)
+	}
+	notify := s.members(channel)
+	if !member {
+		notify = append(notify, u)
+	}
+	s.mu.Unlock()
+	var e protocol.Event
+	if member {
+		e = &protocol.JoinChannel{User: s.protocolUser(u, false), Channel: channel}
+	} else {
+		e = &protocol.LeaveChannel{User: s.protocolUser(u, false), Channel: channel}
+	}
+	for _, m := range notify {
+		s.sendTo(m, e)
+	}
+}
+
+// members returns the users in channel. s.mu must be held.
+func (s *Server) members(channel string) []*User {
+	var members []*User
+	for u, channels := range s.channels {
+		if channels[channel] {
+			members = append(members, u)
+		}
+	}
+	return members
+}
+
+// Publish sends a message from u to channel. u doesn't have to be in the channel.
+func (s *Server) Publish(u *User, channel, message string) {
+	m := Message{
+		User:     u,
+		Channel:  channel,
+		Message:  message,
+		Datetime: time.Now().Unix(),
+	}
+	s.mu.Lock()
+	s.messages = append(s.messages, m)
+	members := s.members(channel)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	e := &protocol.PublishMessage{
+		User:     s.protocolUser(u, false),
+		Channel:  m.Channel,
+		Datetime: m.Datetime,
+		Message:  m.Message,
+	}
+	for _, member := range members {
+		s.sendTo(member, e)
+	}
+}
+
+// Messages returns every message published so far, in order.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// WaitForMessages waits up to timeout for at least n messages to have been published in channel, and
+// returns the messages in that channel.
+func (s *Server) WaitForMessages(channel string, n int, timeout time.Duration) ([]Message, error) {
+	var msgs []Message
+	ok := s.wait(timeout, func() bool {
+		msgs = msgs[:0]
+		for _, m := range s.messages {
+			if m.Channel == channel {
+				msgs = append(msgs, m)
+			}
+		}
+		return len(msgs) >= n
+	})
+	if !ok {
+		return msgs, fmt.Errorf("timed out waiting for %d messages in %s (got %d)", n, channel, len(msgs))
+	}
+	return msgs, nil
+}
+
+// Connections returns the number of open eventhub connections.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// WaitForConnections waits up to timeout for there to be at least n open eventhub connections.
+func (s *Server) WaitForConnections(n int, timeout time.Duration) error {
+	if !s.wait(timeout, func() bool { return len(s.clients) >= n }) {
+		return fmt.Errorf("timed out waiting for %d connections", n)
+	}
+	return nil
+}
+
+// wait waits up to timeout for cond, which is called with s.mu held, to be true.
+func (s *Server) wait(timeout time.Duration, cond func() bool) bool {
+	timer := time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !cond() {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		s.cond.Wait()
+	}
+	return true
+}
+
+// Inject sends a raw frame to every connected client.
+func (s *Server) Inject(frame string) {
+	for _, c := range s.clientList(nil) {
+		c.send(frame)
+	}
+}
+
+// DropConnections closes every eventhub connection, as if the network had failed. Clients may reconnect.
+func (s *Server) DropConnections() {
+	for _, c := range s.clientList(nil) {
+		c.ws.Close()
+	}
+}
+
+// clientList returns the connected clients belonging to u, or all of them if u is nil.
+func (s *Server) clientList(u *User) []*client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var clients []*client
+	for c := range s.clients {
+		if u == nil || c.user == u {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// SendEvent sends an event to all of u's clients.
+func (s *Server) SendEvent(u *User, e protocol.Event) {
+	s.sendTo(u, e)
+}
+
+// sendTo sends an event to all of u's clients.
+func (s *Server) sendTo(u *User, e protocol.Event) {
+	frame, err := protocol.EncodeString(e)
+	if err != nil {
+		panic(err)
+	}
+	for _, c := range s.clientList(u) {
+		c.send(frame)
+	}
+}
+
+// client is a single eventhub connection.
+type client struct {
+	user *User
+	ws   *websocket.Conn
+}
+
+func (c *client) send(frame string) {
+	// Errors mean the connection is going away, which the read loop will notice.
+	websocket.Message.Send(c.ws, frame)
+}
+
+func (s *Server) eventhub(w http.ResponseWriter, r *http.Request) {
+	u, err := s.authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	websocket.Handler(func(ws *websocket.Conn) {
+		c := &client{u, ws}
+		s.mu.Lock()
+		s.clients[c] = true
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			delete(s.clients, c)
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		}()
+		for {
+			var frame string
+			if err := websocket.Message.Receive(ws, &frame); err != nil {
+				return
+			}
+			s.handle(c, frame)
+		}
+	}).ServeHTTP(w, r)
+}
+
+// handle acts on a frame from a client.
+func (s *Server) handle(c *client, frame string) {
+	e, err := protocol.DecodeString(frame)
+	if err != nil {
+		return
+	}
+	switch e := e.(type) {
+	case *protocol.Ping:
+		pong, _ := protocol.EncodeString(&protocol.Pong{Message: e.Message})
+		c.send(pong)
+	case *protocol.JoinChannel:
+		s.setMember(c.user, e.Channel, true)
+	case *protocol.LeaveChannel:
+		s.setMember(c.user, e.Channel, false)
+	case *protocol.PublishMessage:
+		s.Publish(c.user, e.Channel, e.Message)
+	}
+}
@@ -0,0 +1,139 @@
+package prattest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"connection"
+	"pratapi"
+	"protocol"
+)
+
+const timeout = 5 * time.Second
+
+var (
+	botUser = &User{APIKey: "botkey", Secret: "botsecret", Username: "pratbot", Name: "Prat Bot"}
+	alice   = &User{APIKey: "alicekey", Secret: "alicesecret", Username: "alice", Name: "Alice"}
+)
+
+// next returns the next event from conn that isn't a pong.
+func next(t *testing.T, conn *connection.Conn) protocol.Event {
+	for {
+		select {
+		case e := <-conn.In:
+			if _, ok := e.(*protocol.Pong); ok {
+				continue
+			}
+			return e
+		case <-time.After(timeout):
+			t.Fatal("timed out waiting for an event")
+		}
+	}
+}
+
+func expect(t *testing.T, conn *connection.Conn, want protocol.Event) {
+	if got := next(t, conn); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddUser(botUser)
+	s.AddUser(alice)
+	s.Join(alice, "general")
+
+	api := pratapi.New(s.HTTPAddr(), botUser.APIKey, botUser.Secret, nil, nil)
+	me, err := api.WhoAmI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if me.Username != botUser.Username || me.Name != botUser.Name {
+		t.Fatalf("WhoAmI() = %+v", me)
+	}
+	if _, err := pratapi.New(s.HTTPAddr(), botUser.APIKey, "wrong", nil, nil).WhoAmI(); err == nil {
+		t.Fatal("WhoAmI succeeded with the wrong secret")
+	}
+	if _, err := connection.Connect(s.WSAddr(), botUser.APIKey, "wrong", nil); err == nil {
+		t.Fatal("connected with the wrong secret")
+	}
+
+	minDelay := connection.ReconnectMinDelay
+	connection.ReconnectMinDelay = 10 * time.Millisecond
+	defer func() { connection.ReconnectMinDelay = minDelay }()
+	conn, err := connection.Connect(s.WSAddr(), botUser.APIKey, botUser.Secret, &connection.Options{Username: me.Username})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := s.WaitForConnections(1, timeout); err != nil {
+		t.Fatal(err)
+	}
+
+	bot := &protocol.User{Username: "pratbot", Name: "Prat Bot"}
+	a := &protocol.User{Username: "alice", Name: "Alice"}
+	r, err := conn.JoinAck("general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, conn, &protocol.JoinChannel{User: bot, Channel: "general"})
+	if err := r.Wait(timeout); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Members("general"), []string{"alice", "pratbot"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Members() = %v; want %v", got, want)
+	}
+
+	// Other members' messages, joins and leaves reach us.
+	s.Publish(alice, "general", "hi bot")
+	if m, ok := next(t, conn).(*protocol.PublishMessage); !ok || m.User.Username != "alice" || m.Message != "hi bot" {
+		t.Fatalf("got %#v", m)
+	}
+	s.Leave(alice, "general")
+	expect(t, conn, &protocol.LeaveChannel{User: a, Channel: "general"})
+	s.Join(alice, "general")
+	expect(t, conn, &protocol.JoinChannel{User: a, Channel: "general"})
+	// But not ones in channels we aren't in.
+	s.Join(alice, "random")
+	s.Publish(alice, "random", "psst")
+
+	// Our messages are published and echoed back.
+	r, err = conn.SendMessageAck("general", "hi alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := next(t, conn).(*protocol.PublishMessage); !ok || m.User.Username != "pratbot" || m.Message != "hi alice" {
+		t.Fatalf("got %#v", m)
+	}
+	if err := r.Wait(timeout); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := s.WaitForMessages("general", 2, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs[1].User != botUser || msgs[1].Message != "hi alice" {
+		t.Fatalf("published %+v", msgs[1])
+	}
+
+	// After the connection drops, we reconnect and rejoin, and alice leaving didn't make us forget the
+	// channel.
+	s.DropConnections()
+	expect(t, conn, &protocol.JoinChannel{User: bot, Channel: "general"})
+	if got := conn.Channels(); !reflect.DeepEqual(got, []string{"general"}) {
+		t.Fatalf("Channels() = %v after reconnecting", got)
+	}
+	s.Publish(alice, "general", "welcome back")
+	if m, ok := next(t, conn).(*protocol.PublishMessage); !ok || m.Message != "welcome back" {
+		t.Fatalf("got %#v", m)
+	}
+
+	// We hear about leaving too.
+	conn.Leave("general")
+	expect(t, conn, &protocol.LeaveChannel{User: bot, Channel: "general"})
+	if got, want := s.Members("general"), []string{"alice"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Members() = %v; want %v", got, want)
+	}
+}
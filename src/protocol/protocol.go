@@ -0,0 +1,157 @@
+// Package protocol defines the messages spoken over the Prat eventhub websocket.
+//
+// Every message is a JSON object of the form {"action": "...", "data": {...}}. Each action has a
+// corresponding Event type here, which describes the data.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// An Event is the data of an eventhub message.
+type Event interface {
+	// Action returns the name of the message's action, e.g. "publish_message".
+	Action() string
+}
+
+type User struct {
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Name     string   `json:"name"`
+	Gravatar string   `json:"gravatar"`
+	Channels []string `json:"channels,omitempty"`
+}
+
+// PublishMessage is a chat message. When we send one, only Channel and Message are set.
+type PublishMessage struct {
+	User     *User  `json:"user,omitempty"`
+	Channel  string `json:"channel"`
+	Datetime int64  `json:"datetime,omitempty"`
+	Message  string `json:"message"`
+}
+
+// JoinChannel is a request to join a channel, or the server's notice that a user has joined one.
+type JoinChannel struct {
+	User    *User  `json:"user,omitempty"`
+	Channel string `json:"channel"`
+}
+
+// LeaveChannel is a request to leave a channel, or the server's notice that a user has left one.
+type LeaveChannel struct {
+	User    *User  `json:"user,omitempty"`
+	Channel string `json:"channel"`
+}
+
+// UserActive means a user has come online.
+type UserActive struct {
+	User *User `json:"user"`
+}
+
+// UserOffline means a user has gone offline.
+type UserOffline struct {
+	User *User `json:"user"`
+}
+
+// Ping is a heartbeat, answered by a Pong carrying the same message.
+type Ping struct {
+	Message string `json:"message"`
+}
+
+type Pong struct {
+	Message string `json:"message"`
+}
+
+// Unknown holds a message with an unregistered action, so that it can be passed along untouched.
+type Unknown struct {
+	Name string
+	Data json.RawMessage
+}
+
+func (*PublishMessage) Action() string { return "publish_message" }
+func (*JoinChannel) Action() string    { return "join_channel" }
+func (*LeaveChannel) Action() string   { return "leave_channel" }
+func (*UserActive) Action() string     { return "user_active" }
+func (*UserOffline) Action() string    { return "user_offline" }
+func (*Ping) Action() string           { return "ping" }
+func (*Pong) Action() string           { return "pong" }
+func (u *Unknown) Action() string      { return u.Name }
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]func() Event{
+		"publish_message": func() Event { return new(PublishMessage) },
+		"join_channel":    func() Event { return new(JoinChannel) },
+		"leave_channel":   func() Event { return new(LeaveChannel) },
+		"user_active":     func() Event { return new(UserActive) },
+		"user_offline":    func() Event { return new(UserOffline) },
+		"ping":            func() Event { return new(Ping) },
+		"pong":            func() Event { return new(Pong) },
+	}
+)
+
+// Register makes Decode use f to create the Event for messages with the given action. f must return a
+// pointer that the data can be unmarshaled into.
+func Register(action string, f func() Event) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry[action] = f
+}
+
+// envelope is the outer layer of every message. Data is left raw so that it's only parsed once, into the
+// right type.
+type envelope struct {
+	Action string          `json:"action"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// Decode parses a message. Messages with unregistered actions are returned as *Unknown.
+func Decode(frame []byte) (Event, error) {
+	var env envelope
+	if err := json.Unmarshal(frame, &env); err != nil {
+		return nil, err
+	}
+	if env.Action == "" {
+		return nil, errors.New("message has no action")
+	}
+	mu.RLock()
+	f, ok := registry[env.Action]
+	mu.RUnlock()
+	if !ok {
+		return &Unknown{Name: env.Action, Data: env.Data}, nil
+	}
+	e := f()
+	if len(env.Data) > 0 {
+		if err := json.Unmarshal(env.Data, e); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// DecodeString is like Decode, but takes the message as a string.
+func DecodeString(frame string) (Event, error) {
+	return Decode([]byte(frame))
+}
+
+// Encode produces the message for e.
+func Encode(e Event) ([]byte, error) {
+	env := envelope{Action: e.Action()}
+	if u, ok := e.(*Unknown); ok {
+		env.Data = u.Data
+	} else {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		env.Data = data
+	}
+	return json.Marshal(env)
+}
+
+// EncodeString is like Encode, but returns the message as a string.
+func EncodeString(e Event) (string, error) {
+	b, err := Encode(e)
+	return string(b), err
+}
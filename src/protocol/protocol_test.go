@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var alice = &User{
+	Username: "alice",
+	Email:    "alice@example.com",
+	Name:     "Alice",
+	Gravatar: "abc123",
+	Channels: []string{"general", "bot-test"},
+}
+
+func TestRoundTrip(t *testing.T) {
+	events := []Event{
+		&PublishMessage{User: alice, Channel: "general", Datetime: 1381017600, Message: "hello, \"world\""},
+		&PublishMessage{Channel: "general", Message: "what we send"},
+		&JoinChannel{User: alice, Channel: "general"},
+		&JoinChannel{Channel: "general"},
+		&LeaveChannel{User: alice, Channel: "general"},
+		&LeaveChannel{Channel: "general"},
+		&UserActive{User: alice},
+		&UserOffline{User: alice},
+		&Ping{Message: "1381017600"},
+		&Pong{Message: "1381017600"},
+	}
+	covered := make(map[string]bool)
+	for _, e := range events {
+		covered[e.Action()] = true
+		frame, err := Encode(e)
+		if err != nil {
+			t.Fatalf("Encode(%#v): %s", e, err)
+		}
+		got, err := Decode(frame)
+		if err != nil {
+			t.Fatalf("Decode(%s): %s", frame, err)
+		}
+		if !reflect.DeepEqual(got, e) {
+			t.Errorf("round trip of %s: got %#v; want %#v", frame, got, e)
+		}
+
+		var env struct {
+			Action string
+			Data   map[string]interface{}
+		}
+		if err := json.Unmarshal(frame, &env); err != nil {
+			t.Fatal(err)
+		}
+		if env.Action != e.Action() || env.Data == nil {
+			t.Errorf("Encode(%#v) = %s; want action %q with data", e, frame, e.Action())
+		}
+	}
+	for action := range registry {
+		if !covered[action] {
+			t.Errorf("no round trip test for %q", action)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, tt := range []struct {
+		frame string
+		want  Event
+	}{
+		{
+			`{"action":"publish_message","data":{"user":{"username":"alice"},"channel":"general","datetime":5,"message":"hi"}}`,
+			&PublishMessage{User: &User{Username: "alice"}, Channel: "general", Datetime: 5, Message: "hi"},
+		},
+		// Extra fields are ignored.
+		{`{"action":"ping","data":{"message":"x","extra":true},"other":1}`, &Ping{Message: "x"}},
+		// Missing data gives an empty event.
+		{`{"action":"ping"}`, &Ping{}},
+		{`{"action":"user_active","data":null}`, &UserActive{}},
+	} {
+		got, err := DecodeString(tt.frame)
+		if err != nil {
+			t.Errorf("Decode(%s): %s", tt.frame, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Decode(%s) = %#v; want %#v", tt.frame, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, frame := range []string{
+		``,
+		`not json`,
+		`{"data":{"message":"no action"}}`,
+		`{"action":"","data":{}}`,
+		`{"action":"ping","data":"not an object"}`,
+		`{"action":"publish_message","data":{"channel":5}}`,
+	} {
+		if e, err := DecodeString(frame); err == nil {
+			t.Errorf("Decode(%s) = %#v; expected an error", frame, e)
+		}
+	}
+}
+
+func TestUnknownPassthrough(t *testing.T) {
+	for _, frame := range []string{
+		`{"action":"typing","data":{"user":{"username":"alice"},"channel":"general","extra":[1,2,{"x":null}]}}`,
+		`{"action":"typing","data":"a string"}`,
+		`{"action":"typing"}`,
+	} {
+		e, err := DecodeString(frame)
+		if err != nil {
+			t.Fatalf("Decode(%s): %s", frame, err)
+		}
+		u, ok := e.(*Unknown)
+		if !ok {
+			t.Fatalf("Decode(%s) = %#v; want *Unknown", frame, e)
+		}
+		if u.Action() != "typing" {
+			t.Errorf("Decode(%s).Action() = %q", frame, u.Action())
+		}
+		got, err := EncodeString(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != frame {
+			t.Errorf("re-encoding %s gave %s", frame, got)
+		}
+	}
+}
+
+type typing struct {
+	Channel string `json:"channel"`
+}
+
+func (*typing) Action() string { return "test_typing" }
+
+func TestRegister(t *testing.T) {
+	Register("test_typing", func() Event { return new(typing) })
+	defer func() {
+		mu.Lock()
+		delete(registry, "test_typing")
+		mu.Unlock()
+	}()
+	e, err := DecodeString(`{"action":"test_typing","data":{"channel":"general"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e, &typing{Channel: "general"}) {
+		t.Errorf("got %#v", e)
+	}
+}
@@ -0,0 +1,56 @@
+// Package ratelimit provides the token bucket used to rate limit messages, both those we send and those
+// passed to bots.
+package ratelimit
+
+import "time"
+
+// A Bucket allows bursts of up to burst events, refilling at rate events per second. It isn't safe for
+// concurrent use.
+type Bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket. A burst of less than 1 is taken as 1.
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// Delay returns how long until a token is available.
+func (b *Bucket) Delay(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Take takes a token, whether or not there is one (so that the bucket goes into debt).
+func (b *Bucket) Take(now time.Time) {
+	b.refill(now)
+	b.tokens--
+}
+
+// Allow takes a token if there is one, and reports whether there was.
+func (b *Bucket) Allow(now time.Time) bool {
+	if b.Delay(now) > 0 {
+		return false
+	}
+	b.tokens--
+	return true
+}
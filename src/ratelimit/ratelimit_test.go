@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	b := NewBucket(2, 3)
+	for i := 0; i < 3; i++ {
+		if !b.Allow(now) {
+			t.Fatalf("token %d of the burst wasn't allowed", i+1)
+		}
+	}
+	if b.Allow(now) {
+		t.Fatal("allowed more than the burst")
+	}
+	if d := b.Delay(now); d != 500*time.Millisecond {
+		t.Fatalf("Delay() = %s; want 500ms", d)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !b.Allow(now) {
+		t.Fatal("not allowed after refilling")
+	}
+
+	// Taking without a token goes into debt.
+	b.Take(now)
+	if d := b.Delay(now); d != time.Second {
+		t.Fatalf("Delay() = %s after going into debt; want 1s", d)
+	}
+
+	// It never refills past the burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		b.Take(now)
+	}
+	if b.Allow(now) {
+		t.Fatal("refilled past the burst")
+	}
+}
+
+func TestBurstAtLeastOne(t *testing.T) {
+	b := NewBucket(1, 0)
+	now := time.Now()
+	if !b.Allow(now) || b.Allow(now) {
+		t.Fatal("a burst of 0 should allow exactly one")
+	}
+}
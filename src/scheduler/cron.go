@@ -0,0 +1,156 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A cronSpec is a parsed cron expression: the allowed values of each field.
+type cronSpec struct {
+	minute, hour, dom, month, dow map[int]bool
+	// Whether dom and dow were * (unrestricted). If neither was, a day matching either will do.
+	domStar, dowStar bool
+	loc              *time.Location
+}
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a standard five-field cron expression (minute, hour, day of month, month, day of
+// week), or one of the @daily-style shortcuts. Fields may be *, numbers, ranges (1-5), lists (1,3,5) and
+// steps (*/15 or 0-30/10). Sunday is 0 or 7.
+func parseCron(expr string, loc *time.Location) (*cronSpec, error) {
+	if s, ok := cronShortcuts[strings.TrimSpace(expr)]; ok {
+		expr = s
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q should have 5 fields", expr)
+	}
+	c := &cronSpec{loc: loc}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+	c.domStar = fields[2] == "*"
+	c.dowStar = fields[4] == "*"
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("bad step in cron field %q", field)
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("bad cron field %q", field)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("bad cron field %q", field)
+				}
+			} else if step > 1 {
+				// 5/15 means 5, 20, 35, ...
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("cron field %q out of range %d-%d", field, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	if !c.domStar && !c.dowStar {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next returns the first matching time after t, or the zero time if there isn't one in the next few years
+// (e.g. for February 30th).
+//
+// Around daylight saving changes, times that don't exist on the clock are skipped (so a job for 2:30 doesn't
+// fire on the day the clocks go from 2:00 to 3:00), and times that happen twice only match the first time.
+func (c *cronSpec) next(t time.Time) time.Time {
+	after := wallClock(t.In(c.loc))
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + 5
+	for t.Year() <= limit {
+		y, m, d := t.Date()
+		switch {
+		case !c.month[int(m)]:
+			t = forward(t, time.Date(y, m+1, 1, 0, 0, 0, 0, c.loc))
+		case !c.dayMatches(t):
+			t = forward(t, time.Date(y, m, d+1, 0, 0, 0, 0, c.loc))
+		case !c.hour[t.Hour()]:
+			t = nextHour(t)
+		case !c.minute[t.Minute()] || !wallClock(t).After(after):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// nextHour returns the start of the hour after t (which is on a minute). It moves in real time rather than
+// with time.Date, which can normalize a time in a daylight saving gap back to before t.
+func nextHour(t time.Time) time.Time {
+	return t.Add(time.Duration(60-t.Minute()) * time.Minute)
+}
+
+// forward returns to, unless it isn't after from (see nextHour), in which case it returns the next hour.
+func forward(from, to time.Time) time.Time {
+	if to.After(from) {
+		return to
+	}
+	return nextHour(from)
+}
+
+// wallClock returns the time shown on the clock at t, so that times in the hour repeated when daylight
+// saving ends compare as equal.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
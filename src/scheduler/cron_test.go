@@ -0,0 +1,95 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	for _, tt := range []struct {
+		expr string
+		zone string
+		from string
+		want string // empty means never
+	}{
+		{"30 9 * * 1-5", "America/Los_Angeles", "2026-10-17 12:00", "2026-10-19 09:30 -0700"},
+		{"*/15 * * * *", "UTC", "2026-10-17 12:07", "2026-10-17 12:15 +0000"},
+		{"0 0 1 * *", "UTC", "2026-12-31 23:59", "2027-01-01 00:00 +0000"},
+		{"0 12 13 * 5", "UTC", "2026-10-17 12:00", "2026-10-23 12:00 +0000"}, // dom or dow
+		{"0 0 30 2 *", "UTC", "2026-10-17 12:00", ""},
+
+		// The clocks in New York go from 2:00 to 3:00 on 2026-03-08.
+		{"30 2 * * *", "America/New_York", "2026-03-07 12:00", "2026-03-09 02:30 -0400"},
+		{"@daily", "America/New_York", "2026-03-07 12:00", "2026-03-08 00:00 -0500"},
+		{"@weekly", "America/New_York", "2026-03-07 12:00", "2026-03-08 00:00 -0500"},
+		{"@weekly", "America/New_York", "2026-03-08 00:00", "2026-03-15 00:00 -0400"},
+		{"0 * * * *", "America/New_York", "2026-03-08 01:30", "2026-03-08 03:00 -0400"},
+		{"*/20 * * * *", "America/New_York", "2026-03-08 01:45", "2026-03-08 03:00 -0400"},
+		{"0 3 * * *", "America/New_York", "2026-03-08 01:00", "2026-03-08 03:00 -0400"},
+
+		// And from 2:00 back to 1:00 on 2026-11-01.
+		{"30 1 * * *", "America/New_York", "2026-11-01 00:00", "2026-11-01 01:30 -0400"},
+		{"30 1 * * *", "America/New_York", "2026-11-01 01:30", "2026-11-02 01:30 -0500"},
+		{"0 * * * *", "America/New_York", "2026-11-01 01:00", "2026-11-01 02:00 -0500"},
+		{"0 2 * * *", "America/New_York", "2026-11-01 00:00", "2026-11-01 02:00 -0500"},
+	} {
+		loc, err := time.LoadLocation(tt.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := parseCron(tt.expr, loc)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %s", tt.expr, err)
+		}
+		from, err := time.ParseInLocation("2006-01-02 15:04", tt.from, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := c.next(from)
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q after %s: got %s; want never", tt.expr, tt.from, got)
+			}
+			continue
+		}
+		want, err := time.Parse("2006-01-02 15:04 -0700", tt.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("%q after %s in %s: got %s; want %s", tt.expr, tt.from, tt.zone, got, want)
+		}
+	}
+}
+
+// Every job should keep moving forward through a whole year of daylight saving changes.
+func TestCronNextAdvances(t *testing.T) {
+	for _, zone := range []string{"America/New_York", "Europe/London", "Australia/Lord_Howe", "America/Santiago"} {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expr := range []string{"@hourly", "@daily", "@weekly", "30 2 * * *", "0 0,1 * * *"} {
+			c, err := parseCron(expr, loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Date(2026, 1, 1, 0, 0, 0, 0, loc)
+			for next := c.next(start); next.Year() == 2026; {
+				following := c.next(next)
+				if !following.After(next) {
+					t.Fatalf("%q in %s: next after %s is %s", expr, zone, next, following)
+				}
+				next = following
+			}
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "x * * * *"} {
+		if _, err := parseCron(expr, time.UTC); err == nil {
+			t.Errorf("parseCron(%q): expected an error", expr)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Package scheduler runs timers for bots: one-shot, at fixed intervals, or according to cron expressions.
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"fileutil"
+)
+
+// A Job says when to fire a timer for a bot. Exactly one of At, Every and Cron should be set.
+type Job struct {
+	// The bot that gets the timer, and its name for the job. Adding a job replaces any other with the same
+	// Owner and ID.
+	Owner string `json:"owner"`
+	ID    string `json:"id"`
+
+	// Fire once, at this time
+	At time.Time `json:"at,omitempty"`
+	// Fire at this interval
+	Every time.Duration `json:"every,omitempty"`
+	// Fire according to a cron expression (see parseCron), in the time zone named by TimeZone (e.g.
+	// "America/Los_Angeles"; empty means local time).
+	Cron     string `json:"cron,omitempty"`
+	TimeZone string `json:"timezone,omitempty"`
+
+	// Passed back to the bot with each firing
+	Data string `json:"data,omitempty"`
+	// Save the job so that it survives restarts. One-shot jobs whose time passes while we're down fire as
+	// soon as we're back; other firings that are missed are skipped.
+	Persist bool `json:"persist,omitempty"`
+
+	next time.Time
+	cron *cronSpec
+}
+
+// Next returns when j will next fire (zero if it won't).
+func (j *Job) Next() time.Time { return j.next }
+
+// prepare checks j and works out when it first fires after now.
+func (j *Job) prepare(now time.Time) error {
+	if j.Owner == "" || j.ID == "" {
+		return errors.New("job needs an owner and an ID")
+	}
+	set := 0
+	if !j.At.IsZero() {
+		set++
+	}
+	if j.Every != 0 {
+		set++
+	}
+	if j.Cron != "" {
+		set++
+	}
+	if set != 1 {
+		return errors.New("job needs exactly one of At, Every and Cron")
+	}
+	switch {
+	case !j.At.IsZero():
+		j.next = j.At
+	case j.Every > 0:
+		j.next = now.Add(j.Every)
+	case j.Every < 0:
+		return fmt.Errorf("bad interval %s", j.Every)
+	default:
+		loc := time.Local
+		if j.TimeZone != "" {
+			var err error
+			if loc, err = time.LoadLocation(j.TimeZone); err != nil {
+				return err
+			}
+		}
+		c, err := parseCron(j.Cron, loc)
+		if err != nil {
+			return err
+		}
+		j.cron = c
+		if j.next = c.next(now); j.next.IsZero() {
+			return fmt.Errorf("cron expression %q never fires", j.Cron)
+		}
+	}
+	return nil
+}
+
+// advance works out when j fires next after firing at now. It returns false for jobs that are done.
+func (j *Job) advance(now time.Time) bool {
+	switch {
+	case j.Every > 0:
+		// Skip any firings we missed.
+		for !j.next.After(now) {
+			j.next = j.next.Add(j.Every)
+		}
+	case j.cron != nil:
+		j.next = j.cron.next(now)
+	default:
+		j.next = time.Time{}
+	}
+	return !j.next.IsZero()
+}
+
+type jobKey struct{ owner, id string }
+
+// A Scheduler fires jobs by calling its fire function, on its own goroutine.
+type Scheduler struct {
+	path string
+	fire func(j Job, t time.Time)
+
+	mu   sync.Mutex
+	jobs map[jobKey]*Job
+	// Poked when the jobs change
+	wake  chan struct{}
+	done  chan struct{}
+	start sync.Once
+	stop  sync.Once
+}
+
+// New returns a scheduler that calls fire for each job when it's due, with the time it was due. Persistent
+// jobs are kept in the file at path (unless path is empty), and any that are already there are loaded.
+// Nothing fires until Start is called.
+func New(path string, fire func(j Job, t time.Time)) (*Scheduler, error) {
+	s := &Scheduler{
+		path: path,
+		fire: fire,
+		jobs: make(map[jobKey]*Job),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	if path != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Start starts firing jobs.
+func (s *Scheduler) Start() {
+	s.start.Do(func() { go s.run() })
+}
+
+func (s *Scheduler) load() error {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var jobs []*Job
+	if err := json.Unmarshal(b, &jobs); err != nil {
+		return fmt.Errorf("%s: %s", s.path, err)
+	}
+	now := time.Now()
+	for _, j := range jobs {
+		if err := j.prepare(now); err != nil {
+			log.Printf("Warning: dropping saved job %s/%s: %s", j.Owner, j.ID, err)
+			continue
+		}
+		s.jobs[jobKey{j.Owner, j.ID}] = j
+	}
+	return nil
+}
+
+// save writes the persistent jobs to the file. s.mu must be held.
+func (s *Scheduler) save() error {
+	if s.path == "" {
+		return nil
+	}
+	jobs := []*Job{}
+	for _, j := range s.jobs {
+		if j.Persist {
+			jobs = append(jobs, j)
+		}
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		if jobs[a].Owner != jobs[b].Owner {
+			return jobs[a].Owner < jobs[b].Owner
+		}
+		return jobs[a].ID < jobs[b].ID
+	})
+	b, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteFile(s.path, b)
+}
+
+// Add schedules j, replacing any job with the same owner and ID.
+func (s *Scheduler) Add(j Job) error {
+	if err := j.prepare(time.Now()); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, replaced := s.jobs[jobKey{j.Owner, j.ID}]
+	s.jobs[jobKey{j.Owner, j.ID}] = &j
+	s.poke()
+	// A job that replaces a persistent one has to be saved even if it isn't persistent itself, or the old
+	// one would come back after a restart.
+	if j.Persist || (replaced && old.Persist) {
+		return s.save()
+	}
+	return nil
+}
+
+// Remove cancels a job. It returns false if there was no such job.
+func (s *Scheduler) Remove(owner, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[jobKey{owner, id}]
+	if !ok {
+		return false
+	}
+	delete(s.jobs, jobKey{owner, id})
+	s.poke()
+	if j.Persist {
+		if err := s.save(); err != nil {
+			log.Println("Warning: couldn't save scheduled jobs:", err)
+		}
+	}
+	return true
+}
+
+// Jobs returns the owner's jobs, soonest first.
+func (s *Scheduler) Jobs(owner string) []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []Job
+	for _, j := range s.jobs {
+		if j.Owner == owner {
+			jobs = append(jobs, *j)
+		}
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].next.Before(jobs[b].next) })
+	return jobs
+}
+
+// Stop stops firing jobs. Persistent ones are still saved.
+func (s *Scheduler) Stop() {
+	s.stop.Do(func() { close(s.done) })
+}
+
+func (s *Scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// How long to sleep when there are no jobs; it doesn't matter much, since adding one wakes us up.
+const idleWait = time.Hour
+
+func (s *Scheduler) run() {
+	for {
+		s.mu.Lock()
+		wait := idleWait
+		first := true
+		for _, j := range s.jobs {
+			if d := time.Until(j.next); first || d < wait {
+				wait = d
+				first = false
+			}
+		}
+		s.mu.Unlock()
+		if wait < 0 {
+			wait = 0
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			s.fireDue()
+		case <-s.wake:
+			timer.Stop()
+		case <-s.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// fireDue fires every job whose time has come and works out when they fire next.
+func (s *Scheduler) fireDue() {
+	now := time.Now()
+	type firing struct {
+		job Job
+		at  time.Time
+	}
+	var due []firing
+	s.mu.Lock()
+	changed := false
+	for k, j := range s.jobs {
+		if j.next.After(now) {
+			continue
+		}
+		due = append(due, firing{*j, j.next})
+		if !j.advance(now) {
+			delete(s.jobs, k)
+		}
+		changed = changed || j.Persist
+	}
+	if changed {
+		if err := s.save(); err != nil {
+			log.Println("Warning: couldn't save scheduled jobs:", err)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(due, func(a, b int) bool { return due[a].at.Before(due[b].at) })
+	for _, f := range due {
+		s.fire(f.job, f.at)
+	}
+}
@@ -0,0 +1,204 @@
+package scheduler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// tempFile returns the path of a file in a new temporary directory.
+func tempFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "jobs.json")
+}
+
+func ids(jobs []Job) []string {
+	var ids []string
+	for _, j := range jobs {
+		ids = append(ids, j.ID)
+	}
+	return ids
+}
+
+func TestAddErrors(t *testing.T) {
+	s, err := New("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range []Job{
+		{ID: "x", Every: time.Minute},
+		{Owner: "echo", Every: time.Minute},
+		{Owner: "echo", ID: "x"},
+		{Owner: "echo", ID: "x", Every: time.Minute, Cron: "* * * * *"},
+		{Owner: "echo", ID: "x", Every: -time.Minute},
+		{Owner: "echo", ID: "x", Cron: "61 * * * *"},
+		{Owner: "echo", ID: "x", Cron: "0 0 30 2 *"},
+		{Owner: "echo", ID: "x", Cron: "@daily", TimeZone: "Nowhere/Special"},
+	} {
+		if err := s.Add(j); err == nil {
+			t.Errorf("Add(%+v): expected an error", j)
+		}
+	}
+	if jobs := s.Jobs("echo"); len(jobs) != 0 {
+		t.Errorf("bad jobs were added: %+v", jobs)
+	}
+}
+
+func TestAddRemove(t *testing.T) {
+	s, err := New("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, j := range []Job{
+		{Owner: "echo", ID: "later", At: now.Add(2 * time.Hour)},
+		{Owner: "echo", ID: "sooner", Every: time.Hour},
+		{Owner: "echo", ID: "soonest", At: now.Add(time.Minute)},
+		{Owner: "github", ID: "other", Every: time.Minute},
+	} {
+		if err := s.Add(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := ids(s.Jobs("echo")), []string{"soonest", "sooner", "later"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Jobs() = %v; want %v", got, want)
+	}
+	// Adding a job with the same ID replaces it.
+	if err := s.Add(Job{Owner: "echo", ID: "later", At: now.Add(time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(s.Jobs("echo")), []string{"later", "soonest", "sooner"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Jobs() = %v after replacing; want %v", got, want)
+	}
+
+	if !s.Remove("echo", "sooner") {
+		t.Error("Remove returned false for a job that exists")
+	}
+	if s.Remove("echo", "sooner") || s.Remove("echo", "other") {
+		t.Error("Remove returned true for a job that doesn't exist")
+	}
+	if got, want := ids(s.Jobs("echo")), []string{"later", "soonest"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Jobs() = %v after removing; want %v", got, want)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	path := tempFile(t)
+	s, err := New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now().Add(time.Hour).Round(time.Second)
+	for _, j := range []Job{
+		{Owner: "echo", ID: "saved", At: at, Data: "hi", Persist: true},
+		{Owner: "echo", ID: "cron", Cron: "@daily", TimeZone: "UTC", Persist: true},
+		{Owner: "echo", ID: "replaced", Every: time.Minute, Persist: true},
+		{Owner: "echo", ID: "removed", Every: time.Minute, Persist: true},
+		{Owner: "echo", ID: "forgotten", Every: time.Minute},
+	} {
+		if err := s.Add(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Remove("echo", "removed")
+	// Replacing a persistent job with one that isn't forgets it.
+	if err := s.Add(Job{Owner: "echo", ID: "replaced", Every: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	s.Stop()
+
+	s, err = New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := s.Jobs("echo")
+	if got, want := ids(jobs), []string{"saved", "cron"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded %v; want %v", got, want)
+	}
+	if j := jobs[0]; !j.At.Equal(at) || !j.Next().Equal(at) || j.Data != "hi" || !j.Persist {
+		t.Errorf("reloaded %+v", j)
+	}
+	if j := jobs[1]; j.Next().IsZero() || j.Next().Hour() != 0 || j.Next().Location().String() != "UTC" {
+		t.Errorf("reloaded cron job fires next at %s", j.Next())
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(path, nil); err == nil {
+		t.Error("loaded a bad file")
+	}
+}
+
+func TestFire(t *testing.T) {
+	path := tempFile(t)
+	type firing struct {
+		id string
+		at time.Time
+	}
+	fired := make(chan firing, 10)
+	s, err := New(path, func(j Job, at time.Time) { fired <- firing{j.ID, at} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	now := time.Now()
+	for _, j := range []Job{
+		{Owner: "echo", ID: "second", At: now.Add(-time.Minute), Persist: true},
+		{Owner: "echo", ID: "first", At: now.Add(-time.Hour)},
+		{Owner: "echo", ID: "future", At: now.Add(time.Hour), Persist: true},
+	} {
+		if err := s.Add(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Jobs that are already due fire in order, with the time they were due.
+	s.fireDue()
+	for _, want := range []firing{{"first", now.Add(-time.Hour)}, {"second", now.Add(-time.Minute)}} {
+		if got := <-fired; got.id != want.id || !got.at.Equal(want.at) {
+			t.Errorf("fired %s at %s; want %s at %s", got.id, got.at, want.id, want.at)
+		}
+	}
+	select {
+	case f := <-fired:
+		t.Errorf("fired %s early", f.id)
+	default:
+	}
+	// Fired one-shot jobs are gone, from the file too.
+	if got := ids(s.Jobs("echo")); !reflect.DeepEqual(got, []string{"future"}) {
+		t.Errorf("Jobs() = %v after firing; want [future]", got)
+	}
+	reloaded, err := New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(reloaded.Jobs("echo")); !reflect.DeepEqual(got, []string{"future"}) {
+		t.Errorf("reloaded %v after firing; want [future]", got)
+	}
+
+	// Once started, jobs fire on time, repeatedly if they're periodic.
+	s.Start()
+	if err := s.Add(Job{Owner: "echo", ID: "tick", Every: 20 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		select {
+		case f := <-fired:
+			if f.id != "tick" || !f.at.After(last) {
+				t.Fatalf("fired %s at %s after %s", f.id, f.at, last)
+			}
+			last = f.at
+		case <-time.After(time.Second):
+			t.Fatal("periodic job didn't fire")
+		}
+	}
+}